@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+const maxModerationReasonLength = 500
+
+// ModeratedChirp is a chirp as moderators see it, with its moderation state.
+type ModeratedChirp struct {
+	Chirp
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	HiddenAt     *time.Time `json:"hidden_at,omitempty"`
+	HiddenReason string     `json:"hidden_reason,omitempty"`
+}
+
+type suspensionResponse struct {
+	ID              int        `json:"id"`
+	SuspendedAt     *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason string     `json:"suspended_reason,omitempty"`
+}
+
+type ModerationEntry struct {
+	ID          int       `json:"id"`
+	ModeratorID int       `json:"moderator_id"`
+	Action      string    `json:"action"`
+	ChirpID     int       `json:"chirp_id,omitempty"`
+	UserID      int       `json:"user_id"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// handlerAdminChirpsList lists chirps like GET /api/chirps, but can also
+// include hidden and deleted ones (status=hidden|deleted|all) and search
+// the body (q).
+func (cfg *apiConfig) handlerAdminChirpsList(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	values := r.URL.Query()
+	query, err := parseChirpQuery(values)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch status := database.ChirpStatus(values.Get("status")); status {
+	case "", "visible":
+	case database.ChirpsHidden, database.ChirpsDeleted, database.ChirpsAll:
+		query.Status = status
+	default:
+		respondWithError(w, http.StatusBadRequest, "status must be visible, hidden, deleted or all.")
+		return
+	}
+	query.Contains = values.Get("q")
+
+	dbChirps, next, err := cfg.DB.QueryChirps(query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		return
+	}
+
+	chirps := []ModeratedChirp{}
+	for _, dbChirp := range dbChirps {
+		chirps = append(chirps, newModeratedChirp(dbChirp))
+	}
+	setNextPage(w, r, "after", next)
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+func (cfg *apiConfig) handlerAdminChirpsHide(w http.ResponseWriter, r *http.Request) {
+	cfg.moderateChirp(w, r, database.ActionHideChirp)
+}
+
+func (cfg *apiConfig) handlerAdminChirpsUnhide(w http.ResponseWriter, r *http.Request) {
+	cfg.moderateChirp(w, r, database.ActionUnhideChirp)
+}
+
+// handlerAdminChirpsDelete removes a chirp for good, whoever wrote it.
+// Unlike an author's delete it can't be undone.
+func (cfg *apiConfig) handlerAdminChirpsDelete(w http.ResponseWriter, r *http.Request) {
+	cfg.moderateChirp(w, r, database.ActionDeleteChirp)
+}
+
+func (cfg *apiConfig) moderateChirp(w http.ResponseWriter, r *http.Request, action database.ModerationAction) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+	reason, err := decodeReason(r, action != database.ActionUnhideChirp)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, err := cfg.DB.ModerateChirp(database.ModerationEntry{
+		ModeratorID: caller.UserID,
+		Action:      action,
+		ChirpID:     chirpID,
+		Reason:      reason,
+	})
+	if errors.Is(err, database.ErrNoChange) {
+		if action == database.ActionHideChirp {
+			respondWithError(w, http.StatusConflict, "Chirp is already hidden.")
+		} else {
+			respondWithError(w, http.StatusConflict, "Chirp isn't hidden.")
+		}
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't moderate chirp")
+		return
+	}
+
+	if action == database.ActionDeleteChirp {
+		respondWithJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newModeratedChirp(chirp))
+}
+
+func (cfg *apiConfig) handlerAdminUsersSuspend(w http.ResponseWriter, r *http.Request) {
+	cfg.moderateUser(w, r, database.ActionSuspendUser)
+}
+
+func (cfg *apiConfig) handlerAdminUsersUnsuspend(w http.ResponseWriter, r *http.Request) {
+	cfg.moderateUser(w, r, database.ActionUnsuspendUser)
+}
+
+// moderateUser suspends or unsuspends a user. Moderators can only act on
+// users with a lower role than their own, so nobody can suspend themselves.
+func (cfg *apiConfig) moderateUser(w http.ResponseWriter, r *http.Request, action database.ModerationAction) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid User ID.")
+		return
+	}
+	reason, err := decodeReason(r, action == database.ActionSuspendUser)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	target, err := cfg.DB.GetUser(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if target.Role.AtLeast(caller.Role) {
+		respondWithError(w, http.StatusForbidden, "You can't moderate a user with the same or a higher role.")
+		return
+	}
+
+	user, err := cfg.DB.ModerateUser(database.ModerationEntry{
+		ModeratorID: caller.UserID,
+		Action:      action,
+		UserID:      userID,
+		Reason:      reason,
+	})
+	if errors.Is(err, database.ErrNoChange) {
+		if action == database.ActionSuspendUser {
+			respondWithError(w, http.StatusConflict, "User is already suspended.")
+		} else {
+			respondWithError(w, http.StatusConflict, "User isn't suspended.")
+		}
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't moderate user")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, suspensionResponse{
+		ID:              user.ID,
+		SuspendedAt:     optionalTime(user.SuspendedAt),
+		SuspendedReason: user.SuspendedReason,
+	})
+}
+
+// handlerAdminModerationLog lists moderation actions, newest first,
+// optionally filtered by moderator_id, user_id, chirp_id and action.
+func (cfg *apiConfig) handlerAdminModerationLog(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	query, err := parseModerationLogQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbEntries, next, err := cfg.DB.GetModerationLog(query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve moderation log")
+		return
+	}
+
+	entries := []ModerationEntry{}
+	for _, dbEntry := range dbEntries {
+		entries = append(entries, ModerationEntry{
+			ID:          dbEntry.ID,
+			ModeratorID: dbEntry.ModeratorID,
+			Action:      string(dbEntry.Action),
+			ChirpID:     dbEntry.ChirpID,
+			UserID:      dbEntry.UserID,
+			Reason:      dbEntry.Reason,
+			CreatedAt:   dbEntry.CreatedAt,
+		})
+	}
+	setNextPage(w, r, "before", next)
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func parseModerationLogQuery(values url.Values) (database.ModerationLogQuery, error) {
+	query := database.ModerationLogQuery{}
+
+	ids := []struct {
+		param string
+		dest  *int
+	}{
+		{"moderator_id", &query.ModeratorID},
+		{"user_id", &query.UserID},
+		{"chirp_id", &query.ChirpID},
+		{"before", &query.Before},
+	}
+	for _, id := range ids {
+		if s := values.Get(id.param); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return query, fmt.Errorf("Invalid %s.", id.param)
+			}
+			*id.dest = n
+		}
+	}
+
+	query.Action = database.ModerationAction(values.Get("action"))
+
+	limit, err := parseLimit(values)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+
+	return query, nil
+}
+
+// decodeReason reads the moderator's reason from the request body. An
+// empty body is allowed when the reason is optional.
+func decodeReason(r *http.Request, required bool) (string, error) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !(errors.Is(err, io.EOF) && !required) {
+		return "", errors.New("Couldn't decode parameters")
+	}
+	reason := strings.TrimSpace(params.Reason)
+	if required && reason == "" {
+		return "", errors.New("A reason is required.")
+	}
+	if len(reason) > maxModerationReasonLength {
+		return "", fmt.Errorf("Reason can be at most %d characters.", maxModerationReasonLength)
+	}
+	return reason, nil
+}
+
+func newModeratedChirp(chirp database.Chirp) ModeratedChirp {
+	return ModeratedChirp{
+		Chirp: Chirp{
+			ID:        chirp.ID,
+			Body:      chirp.Body,
+			AuthorID:  chirp.AuthorID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+		},
+		DeletedAt:    optionalTime(chirp.DeletedAt),
+		HiddenAt:     optionalTime(chirp.HiddenAt),
+		HiddenReason: chirp.HiddenReason,
+	}
+}
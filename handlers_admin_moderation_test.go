@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+// newModerationRouter serves the moderation API, the report queue and the
+// public chirp routes, and returns a token of a moderator.
+func newModerationRouter(t *testing.T, cfg *apiConfig) (http.Handler, string) {
+	t.Helper()
+	moderator, err := cfg.DB.CreateUser("mod@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderator, err = cfg.DB.SetUserRole(moderator.ID, database.RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/chirps/{chirpID}", cfg.handlerChirpsGetId)
+	router.With(cfg.middlewareAuth).Put("/api/chirps/{chirpID}", cfg.handlerChirpsUpdate)
+	router.With(cfg.middlewareAuth).Post("/api/chirps/{chirpID}/reports", cfg.handlerChirpsReport)
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(cfg.middlewareAuth)
+		r.Use(cfg.middlewareRequireRole(database.RoleModerator))
+		r.Get("/chirps", cfg.handlerAdminChirpsList)
+		r.Post("/chirps/{chirpID}/hide", cfg.handlerAdminChirpsHide)
+		r.Post("/chirps/{chirpID}/unhide", cfg.handlerAdminChirpsUnhide)
+		r.Delete("/chirps/{chirpID}", cfg.handlerAdminChirpsDelete)
+		r.Post("/users/{userID}/suspend", cfg.handlerAdminUsersSuspend)
+		r.Post("/users/{userID}/unsuspend", cfg.handlerAdminUsersUnsuspend)
+		r.Get("/moderation-log", cfg.handlerAdminModerationLog)
+		r.Get("/reports", cfg.handlerAdminReportsList)
+		r.Post("/chirps/{chirpID}/reports/resolve", cfg.handlerAdminReportsResolve)
+	})
+	return router, mustCreateJwt(t, cfg, moderator)
+}
+
+func TestHandlerAdminChirps(t *testing.T) {
+	cfg := newTestConfig(t)
+	router, modToken := newModerationRouter(t, cfg)
+	author, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("buy now", author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorToken := accessToken(t, cfg, author.ID)
+	target := fmt.Sprintf("/admin/chirps/%d", chirp.ID)
+	public := fmt.Sprintf("/api/chirps/%d", chirp.ID)
+
+	steps := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{"plain user", "GET", "/admin/chirps", authorToken, "", http.StatusForbidden},
+		{"hide without reason", "POST", target + "/hide", modToken, `{"reason":" "}`, http.StatusBadRequest},
+		{"hide missing chirp", "POST", "/admin/chirps/99/hide", modToken, `{"reason":"spam"}`, http.StatusNotFound},
+		{"hide", "POST", target + "/hide", modToken, `{"reason":"spam"}`, http.StatusOK},
+		{"hide again", "POST", target + "/hide", modToken, `{"reason":"spam"}`, http.StatusConflict},
+		{"get hidden", "GET", public, "", "", http.StatusNotFound},
+		{"author edits hidden", "PUT", public, authorToken, `{"body":"edited"}`, http.StatusForbidden},
+		{"invalid status", "GET", "/admin/chirps?status=bogus", modToken, "", http.StatusBadRequest},
+		{"unhide without body", "POST", target + "/unhide", modToken, "", http.StatusOK},
+		{"unhide again", "POST", target + "/unhide", modToken, "", http.StatusConflict},
+		{"get unhidden", "GET", public, "", "", http.StatusOK},
+		{"delete", "DELETE", target, modToken, `{"reason":"spam"}`, http.StatusOK},
+		{"get deleted", "GET", public, "", "", http.StatusNotFound},
+		{"delete again", "DELETE", target, modToken, `{"reason":"spam"}`, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		w := serve(router, step.method, step.target, step.body, bearer(step.token))
+		if w.Code != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantCode, w.Body)
+		}
+	}
+
+	t.Run("list", func(t *testing.T) {
+		hidden, err := cfg.DB.CreateChirp("more spam", author.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := serve(router, "POST", fmt.Sprintf("/admin/chirps/%d/hide", hidden.ID), `{"reason":"spam"}`, bearer(modToken)).Code
+		if code != http.StatusOK {
+			t.Fatalf("hide: status = %d, want %d", code, http.StatusOK)
+		}
+		w := serve(router, "GET", "/admin/chirps?status=hidden&q=SPAM", "", bearer(modToken))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		chirps := []ModeratedChirp{}
+		err = json.NewDecoder(w.Body).Decode(&chirps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) != 1 || chirps[0].ID != hidden.ID || chirps[0].HiddenAt == nil || chirps[0].HiddenReason != "spam" {
+			t.Errorf("chirps = %+v, want only the hidden chirp %d", chirps, hidden.ID)
+		}
+	})
+}
+
+func TestHandlerAdminUsersSuspend(t *testing.T) {
+	cfg := newTestConfig(t)
+	router, modToken := newModerationRouter(t, cfg)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.DB.CreateUser("other@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.DB.SetUserRole(other.ID, database.RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := login(t, cfg, "a@example.com", "password")
+	protected := cfg.middlewareAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target := fmt.Sprintf("/admin/users/%d", user.ID)
+	loginCode := func() int {
+		body := `{"email":"a@example.com","password":"password"}`
+		return serve(http.HandlerFunc(cfg.handlerUsersLogin), "POST", "/api/login", body, nil).Code
+	}
+
+	steps := []struct {
+		name     string
+		target   string
+		body     string
+		wantCode int
+	}{
+		{"without reason", target + "/suspend", "", http.StatusBadRequest},
+		{"invalid ID", "/admin/users/x/suspend", `{"reason":"abuse"}`, http.StatusBadRequest},
+		{"unknown user", "/admin/users/99/suspend", `{"reason":"abuse"}`, http.StatusNotFound},
+		{"same role", fmt.Sprintf("/admin/users/%d/suspend", other.ID), `{"reason":"abuse"}`, http.StatusForbidden},
+		{"suspend", target + "/suspend", `{"reason":"abuse"}`, http.StatusOK},
+		{"suspend again", target + "/suspend", `{"reason":"abuse"}`, http.StatusConflict},
+	}
+	for _, step := range steps {
+		w := serve(router, "POST", step.target, step.body, bearer(modToken))
+		if w.Code != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantCode, w.Body)
+		}
+	}
+
+	// A suspended user is signed out and can't sign back in.
+	if code := serve(protected, "GET", "/api/users/me", "", bearer(session.Token)).Code; code != http.StatusUnauthorized {
+		t.Errorf("access token while suspended: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	// Even a session the store still knows of is refused.
+	if code := serve(protected, "GET", "/api/users/me", "", bearer(accessToken(t, cfg, user.ID))).Code; code != http.StatusForbidden {
+		t.Errorf("new session while suspended: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := loginCode(); code != http.StatusForbidden {
+		t.Errorf("login while suspended: status = %d, want %d", code, http.StatusForbidden)
+	}
+	code := serve(http.HandlerFunc(cfg.handlerTokenRefresh), "POST", "/api/refresh", "", bearer(session.RefreshToken)).Code
+	if code != http.StatusUnauthorized {
+		t.Errorf("refresh while suspended: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := serve(router, "POST", target+"/unsuspend", "", bearer(modToken)).Code; code != http.StatusOK {
+		t.Fatalf("unsuspend: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(router, "POST", target+"/unsuspend", "", bearer(modToken)).Code; code != http.StatusConflict {
+		t.Errorf("unsuspend again: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := loginCode(); code != http.StatusOK {
+		t.Errorf("login after unsuspension: status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHandlerAdminModerationLog(t *testing.T) {
+	cfg := newTestConfig(t)
+	router, modToken := newModerationRouter(t, cfg)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("chirp", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{
+		fmt.Sprintf("/admin/chirps/%d/hide", chirp.ID),
+		fmt.Sprintf("/admin/chirps/%d/unhide", chirp.ID),
+		fmt.Sprintf("/admin/users/%d/suspend", user.ID),
+	} {
+		code := serve(router, "POST", target, `{"reason":"abuse"}`, bearer(modToken)).Code
+		if code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", target, code, http.StatusOK)
+		}
+	}
+
+	for _, query := range []string{"moderator_id=x", "chirp_id=0", "limit=0"} {
+		if code := serve(router, "GET", "/admin/moderation-log?"+query, "", bearer(modToken)).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+
+	w := serve(router, "GET", fmt.Sprintf("/admin/moderation-log?chirp_id=%d&limit=1", chirp.ID), "", bearer(modToken))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	entries := []ModerationEntry{}
+	err = json.NewDecoder(w.Body).Decode(&entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "unhide_chirp" || entries[0].UserID != user.ID {
+		t.Errorf("entries = %+v, want the unhide of chirp %d", entries, chirp.ID)
+	}
+	if w.Header().Get("X-Next-Cursor") != fmt.Sprint(entries[0].ID) {
+		t.Errorf("X-Next-Cursor = %q, want %d", w.Header().Get("X-Next-Cursor"), entries[0].ID)
+	}
+}
+
+// failingStore fails every moderation, as a store with a broken disk would.
+type failingStore struct {
+	database.Store
+}
+
+func (failingStore) ModerateChirp(database.ModerationEntry) (database.Chirp, error) {
+	return database.Chirp{}, errors.New("disk failure")
+}
+
+func (failingStore) ModerateUser(database.ModerationEntry) (database.User, error) {
+	return database.User{}, errors.New("disk failure")
+}
+
+func TestHandlerAdminModerationStoreErrors(t *testing.T) {
+	cfg := newTestConfig(t)
+	router, modToken := newModerationRouter(t, cfg)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("buy now", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DB = failingStore{cfg.DB}
+
+	for _, target := range []string{
+		fmt.Sprintf("/admin/chirps/%d/hide", chirp.ID),
+		fmt.Sprintf("/admin/users/%d/suspend", user.ID),
+	} {
+		code := serve(router, "POST", target, `{"reason":"spam"}`, bearer(modToken)).Code
+		if code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want %d", target, code, http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+// Report is a report as moderators see it. Chirp is omitted once the chirp
+// has been deleted.
+type Report struct {
+	ID         int             `json:"id"`
+	ChirpID    int             `json:"chirp_id"`
+	ReporterID int             `json:"reporter_id"`
+	Reason     string          `json:"reason"`
+	Details    string          `json:"details"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ResolvedAt *time.Time      `json:"resolved_at,omitempty"`
+	ResolverID int             `json:"resolver_id,omitempty"`
+	Resolution string          `json:"resolution,omitempty"`
+	Note       string          `json:"note,omitempty"`
+	Chirp      *ModeratedChirp `json:"chirp,omitempty"`
+}
+
+type resolveResponse struct {
+	ChirpID    int    `json:"chirp_id"`
+	Resolution string `json:"resolution"`
+	Resolved   int    `json:"resolved"`
+}
+
+// handlerAdminReportsList is the review queue: open reports, oldest first,
+// each with the chirp it is about. status=resolved|all includes closed
+// reports; chirp_id and reason filter.
+func (cfg *apiConfig) handlerAdminReportsList(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	query, err := parseReportQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbReports, next, err := cfg.DB.GetReports(query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve reports")
+		return
+	}
+
+	chirps := map[int]*ModeratedChirp{}
+	reports := []Report{}
+	for _, dbReport := range dbReports {
+		chirp, seen := chirps[dbReport.ChirpID]
+		if !seen {
+			dbChirp, err := cfg.DB.GetChirpById(dbReport.ChirpID)
+			if err == nil {
+				moderated := newModeratedChirp(dbChirp)
+				chirp = &moderated
+			}
+			chirps[dbReport.ChirpID] = chirp
+		}
+		reports = append(reports, Report{
+			ID:         dbReport.ID,
+			ChirpID:    dbReport.ChirpID,
+			ReporterID: dbReport.ReporterID,
+			Reason:     string(dbReport.Reason),
+			Details:    dbReport.Details,
+			CreatedAt:  dbReport.CreatedAt,
+			ResolvedAt: optionalTime(dbReport.ResolvedAt),
+			ResolverID: dbReport.ResolverID,
+			Resolution: string(dbReport.Resolution),
+			Note:       dbReport.Note,
+			Chirp:      chirp,
+		})
+	}
+	setNextPage(w, r, "after", next)
+	respondWithJSON(w, http.StatusOK, reports)
+}
+
+// handlerAdminReportsResolve closes every open report on a chirp. The
+// resolution is dismissed, hidden or deleted; the last two also hide or
+// delete the chirp and need a note, which goes into the moderation log.
+// Dismissing unhides the chirp if the reports hid it automatically, so a
+// brigade can't keep a chirp hidden past review; a chirp a moderator hid
+// stays hidden.
+func (cfg *apiConfig) handlerAdminReportsResolve(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+
+	type parameters struct {
+		Resolution string `json:"resolution"`
+		Note       string `json:"note"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	resolution := database.Resolution(params.Resolution)
+	switch resolution {
+	case database.ResolutionDismissed, database.ResolutionHidden, database.ResolutionDeleted:
+	default:
+		respondWithError(w, http.StatusBadRequest, "resolution must be dismissed, hidden or deleted.")
+		return
+	}
+	note := strings.TrimSpace(params.Note)
+	if note == "" && resolution != database.ResolutionDismissed {
+		respondWithError(w, http.StatusBadRequest, "A note is required.")
+		return
+	}
+	if len(note) > maxModerationReasonLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Note can be at most %d characters.", maxModerationReasonLength))
+		return
+	}
+
+	resolved, err := cfg.DB.ResolveReports(chirpID, caller.UserID, resolution, note)
+	if errors.Is(err, database.ErrNoChange) {
+		respondWithError(w, http.StatusConflict, "Chirp has no open reports.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve reports")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resolveResponse{
+		ChirpID:    chirpID,
+		Resolution: string(resolution),
+		Resolved:   resolved,
+	})
+}
+
+func parseReportQuery(values url.Values) (database.ReportQuery, error) {
+	query := database.ReportQuery{}
+
+	switch status := database.ReportStatus(values.Get("status")); status {
+	case "", "open":
+	case database.ReportsResolved, database.ReportsAll:
+		query.Status = status
+	default:
+		return query, errors.New("status must be open, resolved or all.")
+	}
+
+	if s := values.Get("reason"); s != "" {
+		reason, err := database.ParseReportReason(s)
+		if err != nil {
+			return query, err
+		}
+		query.Reason = reason
+	}
+
+	ids := []struct {
+		param string
+		dest  *int
+	}{
+		{"chirp_id", &query.ChirpID},
+		{"after", &query.After},
+	}
+	for _, id := range ids {
+		if s := values.Get(id.param); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return query, fmt.Errorf("Invalid %s.", id.param)
+			}
+			*id.dest = n
+		}
+	}
+
+	limit, err := parseLimit(values)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+
+	return query, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+type roleResponse struct {
+	ID   int    `json:"id"`
+	Role string `json:"role"`
+}
+
+// handlerAdminUsersSetRole changes the role of a user. Admins can't change
+// their own role, so there is always at least one admin left.
+func (cfg *apiConfig) handlerAdminUsersSetRole(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid User ID.")
+		return
+	}
+	if userID == caller.UserID {
+		respondWithError(w, http.StatusForbidden, "You can't change your own role.")
+		return
+	}
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	role, err := database.ParseRole(params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := cfg.DB.SetUserRole(userID, role)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	log.Printf("User %d set the role of user %d to %s.", caller.UserID, user.ID, user.Role)
+	respondWithJSON(w, http.StatusOK, roleResponse{ID: user.ID, Role: string(user.Role)})
+}
+
+// bootstrapAdmin makes the user with the given email an admin, so that a
+// fresh deployment has someone who can hand out roles. The user must have
+// signed up and verified the email already, and it only happens while
+// there is no admin; otherwise anyone who registers that address first
+// would get the role.
+func bootstrapAdmin(db database.Store, email string) error {
+	admins, err := db.CountUsers(database.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		log.Printf("Not making %s an admin (ADMIN_EMAIL): there already is one.", email)
+		return nil
+	}
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if !user.EmailVerified {
+		log.Printf("Not making user %d an admin (ADMIN_EMAIL): the email isn't verified.", user.ID)
+		return nil
+	}
+	_, err = db.SetUserRole(user.ID, database.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	log.Printf("Made user %d an admin (ADMIN_EMAIL).", user.ID)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+func TestHandlerAdminUsersSetRole(t *testing.T) {
+	cfg := newTestConfig(t)
+	admin, err := cfg.DB.CreateUser("admin@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err = cfg.DB.SetUserRole(admin.ID, database.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Use(cfg.middlewareAuth)
+	router.Use(cfg.middlewareRequireRole(database.RoleAdmin))
+	router.Put("/admin/users/{userID}/role", cfg.handlerAdminUsersSetRole)
+	adminToken := mustCreateJwt(t, cfg, admin)
+	target := fmt.Sprintf("/admin/users/%d/role", user.ID)
+
+	tests := []struct {
+		name     string
+		target   string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{"anonymous", target, "", `{"role":"admin"}`, http.StatusUnauthorized},
+		{"plain user", target, accessToken(t, cfg, user.ID), `{"role":"admin"}`, http.StatusForbidden},
+		// A token can't claim a role its user doesn't have in the store.
+		{"claimed role", target, mustCreateJwt(t, cfg, database.User{ID: user.ID, Role: database.RoleAdmin}), `{"role":"admin"}`, http.StatusForbidden},
+		{"own role", fmt.Sprintf("/admin/users/%d/role", admin.ID), adminToken, `{"role":"user"}`, http.StatusForbidden},
+		{"unknown role", target, adminToken, `{"role":"root"}`, http.StatusBadRequest},
+		{"invalid ID", "/admin/users/x/role", adminToken, `{"role":"moderator"}`, http.StatusBadRequest},
+		{"unknown user", "/admin/users/99/role", adminToken, `{"role":"moderator"}`, http.StatusNotFound},
+		{"promote", target, adminToken, `{"role":"admin"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, "PUT", tt.target, tt.body, bearer(tt.token))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+
+	// Role changes take effect on the next request: the promoted user's
+	// token still claims the role user, and the demoted admin's claims
+	// admin.
+	code := serve(router, "PUT", fmt.Sprintf("/admin/users/%d/role", admin.ID), `{"role":"user"}`, bearer(accessToken(t, cfg, user.ID))).Code
+	if code != http.StatusOK {
+		t.Fatalf("demote: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(router, "PUT", target, `{"role":"user"}`, bearer(adminToken)).Code; code != http.StatusForbidden {
+		t.Errorf("demoted admin: status = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	cfg := newTestConfig(t)
+	role := func(id int) database.Role {
+		t.Helper()
+		user, err := cfg.DB.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Role
+	}
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.DB.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bootstrapAdmin(cfg.DB, "nobody@example.com"); err == nil {
+		t.Error("bootstrapAdmin() accepted an unknown email")
+	}
+
+	err = bootstrapAdmin(cfg.DB, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := role(user.ID); got != database.RoleUser {
+		t.Errorf("unverified user's role = %q, want %q", got, database.RoleUser)
+	}
+
+	for _, u := range []database.User{user, other} {
+		_, err = cfg.DB.VerifyEmail(u.ID, u.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bootstrapAdmin(cfg.DB, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := role(user.ID); got != database.RoleAdmin {
+		t.Errorf("verified user's role = %q, want %q", got, database.RoleAdmin)
+	}
+
+	err = bootstrapAdmin(cfg.DB, "b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := role(other.ID); got != database.RoleUser {
+		t.Errorf("role with an admin already there = %q, want %q", got, database.RoleUser)
+	}
+}
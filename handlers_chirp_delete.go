@@ -1,41 +1,17 @@
-
 package main
 
 import (
 	"net/http"
 	"strconv"
-	"strings"
-	"log"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 func (cfg *apiConfig) handlerChirpDelete(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
-	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(cfg.jwt), nil },
-	)
-
-	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	strid, err := token.Claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-	author_id, err := strconv.Atoi(strid)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
 		return
 	}
 
@@ -50,8 +26,12 @@ func (cfg *apiConfig) handlerChirpDelete(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusNotFound, "No chirp found.")
 		return
 	}
+	if chirp.IsDeleted() {
+		respondWithError(w, http.StatusGone, "Chirp was deleted.")
+		return
+	}
 
-	if chirp.AuthorID != author_id {
+	if chirp.AuthorID != caller.UserID {
 		respondWithError(w, http.StatusForbidden, "Can't delete tweet with different author")
 		return
 	}
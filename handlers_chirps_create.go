@@ -5,32 +5,22 @@ import (
 	"errors"
 	"net/http"
 	"strings"
-	"log"
-	"strconv"
-
-	"github.com/golang-jwt/jwt/v5"
+	"time"
 )
 
 type Chirp struct {
-	ID     int    `json:"id"`
-	Body   string `json:"body"`
-	AuthorID int `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
-	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(cfg.jwt), nil },
-	)
-
-	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
 		return
 	}
 
@@ -40,7 +30,7 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
@@ -52,28 +42,18 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	strid, err := token.Claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-	author_id, err := strconv.Atoi(strid)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	chirp, err := cfg.DB.CreateChirp(cleaned, author_id)
+	chirp, err := cfg.DB.CreateChirp(cleaned, caller.UserID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
 		return
 	}
-	
 
 	respondWithJSON(w, http.StatusCreated, Chirp{
-		ID:   chirp.ID,
-		Body: chirp.Body,
-		AuthorID: chirp.AuthorID, 
+		ID:        chirp.ID,
+		Body:      chirp.Body,
+		AuthorID:  chirp.AuthorID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
 	})
 }
 
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+// Lists are paged: limit defaults to defaultChirpsLimit and can't exceed
+// maxChirpsLimit. GET /api/chirps without limit or after still returns
+// every chirp, as it did before paging existed.
+const (
+	defaultChirpsLimit = 50
+	maxChirpsLimit     = 100
 )
 
 func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
 
-	dbChirps, err := cfg.DB.GetChirps()
+	query, err := parseChirpQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbChirps, next, err := cfg.DB.QueryChirps(query)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
 		return
@@ -17,15 +36,80 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
 	chirps := []Chirp{}
 	for _, dbChirp := range dbChirps {
 		chirps = append(chirps, Chirp{
-			ID:   dbChirp.ID,
-			Body: dbChirp.Body,
-			AuthorID: dbChirp.AuthorID,
+			ID:        dbChirp.ID,
+			Body:      dbChirp.Body,
+			AuthorID:  dbChirp.AuthorID,
+			CreatedAt: dbChirp.CreatedAt,
+			UpdatedAt: dbChirp.UpdatedAt,
 		})
 	}
 
-	sort.Slice(chirps, func(i, j int) bool {
-		return chirps[i].ID < chirps[j].ID
-	})
-
+	setNextPage(w, r, "after", next)
 	respondWithJSON(w, http.StatusOK, chirps)
 }
+
+// setNextPage links to the next page of results, which starts at the cursor
+// next passed as the query parameter param. Zero means there is no next page.
+func setNextPage(w http.ResponseWriter, r *http.Request, param string, next int) {
+	if next == 0 {
+		return
+	}
+	nextQuery := r.URL.Query()
+	nextQuery.Set(param, strconv.Itoa(next))
+	nextURL := url.URL{Path: r.URL.Path, RawQuery: nextQuery.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.String()))
+	w.Header().Set("X-Next-Cursor", strconv.Itoa(next))
+}
+
+// parseLimit reads the page size from the limit parameter.
+func parseLimit(values url.Values) (int, error) {
+	s := values.Get("limit")
+	if s == "" {
+		return defaultChirpsLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxChirpsLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d.", maxChirpsLimit)
+	}
+	return limit, nil
+}
+
+func parseChirpQuery(values url.Values) (database.ChirpQuery, error) {
+	query := database.ChirpQuery{}
+
+	if s := values.Get("author_id"); s != "" {
+		authorID, err := strconv.Atoi(s)
+		if err != nil || authorID < 1 {
+			return query, errors.New("Invalid author_id.")
+		}
+		query.AuthorID = authorID
+	}
+
+	switch values.Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New("sort must be asc or desc.")
+	}
+
+	limit, err := parseLimit(values)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+
+	if s := values.Get("after"); s != "" {
+		after, err := strconv.Atoi(s)
+		if err != nil || after < 1 {
+			return query, errors.New("Invalid after cursor.")
+		}
+		query.After = after
+	}
+
+	if !values.Has("limit") && !values.Has("after") {
+		query.Limit = 0
+	}
+
+	return query, nil
+}
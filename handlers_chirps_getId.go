@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"net/http"
 	"strconv"
 
@@ -18,15 +17,20 @@ func (cfg *apiConfig) handlerChirpsGetId(w http.ResponseWriter, r *http.Request)
 	}
 
 	chirp, err := cfg.DB.GetChirpById(chirpid)
-	if err != nil {
+	if err != nil || chirp.IsHidden() {
 		respondWithError(w, http.StatusNotFound, "No chirp found.")
 		return
 	}
-
-	dat, err := json.Marshal(chirp)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Bad JSON")
+	if chirp.IsDeleted() {
+		respondWithError(w, http.StatusGone, "Chirp was deleted.")
 		return
 	}
-	w.Write(dat)
+
+	respondWithJSON(w, http.StatusOK, Chirp{
+		ID:        chirp.ID,
+		Body:      chirp.Body,
+		AuthorID:  chirp.AuthorID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	})
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHandlerChirpsRetrieve(t *testing.T) {
+	cfg := newTestConfig(t)
+	a, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cfg.DB.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, author := range []int{a.ID, b.ID, a.ID} {
+		_, err = cfg.DB.CreateChirp("chirp", author)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := http.HandlerFunc(cfg.handlerChirpsRetrieve)
+
+	tests := []struct {
+		target   string
+		wantCode int
+		wantIDs  []int
+		wantNext string
+	}{
+		{"/api/chirps", http.StatusOK, []int{1, 2, 3}, ""},
+		{"/api/chirps?sort=desc", http.StatusOK, []int{3, 2, 1}, ""},
+		{"/api/chirps?author_id=1", http.StatusOK, []int{1, 3}, ""},
+		{"/api/chirps?limit=2", http.StatusOK, []int{1, 2}, "2"},
+		{"/api/chirps?limit=2&after=2", http.StatusOK, []int{3}, ""},
+		{"/api/chirps?sort=up", http.StatusBadRequest, nil, ""},
+		{"/api/chirps?author_id=x", http.StatusBadRequest, nil, ""},
+		{"/api/chirps?limit=0", http.StatusBadRequest, nil, ""},
+		{"/api/chirps?limit=101", http.StatusBadRequest, nil, ""},
+		{"/api/chirps?after=-1", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := serve(handler, "GET", tt.target, "", nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			chirps := []Chirp{}
+			err := json.Unmarshal(w.Body.Bytes(), &chirps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, chirp := range chirps {
+				ids = append(ids, chirp.ID)
+			}
+			if len(ids) != len(tt.wantIDs) {
+				t.Fatalf("chirps = %v, want %v", ids, tt.wantIDs)
+			}
+			for i := range ids {
+				if ids[i] != tt.wantIDs[i] {
+					t.Fatalf("chirps = %v, want %v", ids, tt.wantIDs)
+				}
+			}
+			if next := w.Header().Get("X-Next-Cursor"); next != tt.wantNext {
+				t.Errorf("X-Next-Cursor = %q, want %q", next, tt.wantNext)
+			}
+			if tt.wantNext != "" && w.Header().Get("Link") == "" {
+				t.Error("no Link header for the next page")
+			}
+		})
+	}
+}
+
+func TestHandlerChirpsRetrieveDefaultLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= defaultChirpsLimit; i++ {
+		_, err = cfg.DB.CreateChirp("chirp", user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target   string
+		want     int
+		wantNext string
+	}{
+		// Clients that don't page still get everything.
+		{"/api/chirps", defaultChirpsLimit + 1, ""},
+		{"/api/chirps?sort=desc", defaultChirpsLimit + 1, ""},
+		{"/api/chirps?after=1", defaultChirpsLimit, ""},
+		{"/api/chirps?sort=desc&after=" + strconv.Itoa(defaultChirpsLimit+1), defaultChirpsLimit, ""},
+		{"/api/chirps?limit=10", 10, "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := serve(http.HandlerFunc(cfg.handlerChirpsRetrieve), "GET", tt.target, "", nil)
+			chirps := []Chirp{}
+			err := json.Unmarshal(w.Body.Bytes(), &chirps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != tt.want {
+				t.Errorf("got %d chirps, want %d", len(chirps), tt.want)
+			}
+			if next := w.Header().Get("X-Next-Cursor"); next != tt.wantNext {
+				t.Errorf("X-Next-Cursor = %q, want %q", next, tt.wantNext)
+			}
+		})
+	}
+}
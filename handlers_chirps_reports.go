@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+const maxReportDetailsLength = 500
+
+type reportResponse struct {
+	ID        int       `json:"id"`
+	ChirpID   int       `json:"chirp_id"`
+	Reason    string    `json:"reason"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// handlerChirpsReport flags a chirp for moderators. Each user can report a
+// chirp once; enough open reports hide the chirp until a moderator
+// resolves them.
+func (cfg *apiConfig) handlerChirpsReport(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+
+	type parameters struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	reason, err := database.ParseReportReason(params.Reason)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(params.Details) > maxReportDetailsLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Details can be at most %d characters.", maxReportDetailsLength))
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirpById(chirpID)
+	if err != nil || !chirp.IsVisible() {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+	if chirp.AuthorID == caller.UserID {
+		respondWithError(w, http.StatusBadRequest, "You can't report your own chirp.")
+		return
+	}
+
+	report, hidden, err := cfg.DB.CreateReport(database.Report{
+		ChirpID:    chirpID,
+		ReporterID: caller.UserID,
+		Reason:     reason,
+		Details:    params.Details,
+	}, cfg.reportsToHide)
+	if errors.Is(err, database.ErrAlreadyReported) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+	if hidden {
+		log.Printf("Chirp %d hidden after %d reports.", chirpID, cfg.reportsToHide)
+	}
+
+	respondWithJSON(w, http.StatusCreated, reportResponse{
+		ID:        report.ID,
+		ChirpID:   report.ChirpID,
+		Reason:    string(report.Reason),
+		Details:   report.Details,
+		CreatedAt: report.CreatedAt,
+	})
+}
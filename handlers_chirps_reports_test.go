@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+func TestHandlerChirpsReport(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.reportsToHide = 2
+	author, err := cfg.DB.CreateUser("author@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []string{}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		user, err := cfg.DB.CreateUser(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, accessToken(t, cfg, user.ID))
+	}
+	chirp, err := cfg.DB.CreateChirp("spam", author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Get("/api/chirps/{chirpID}", cfg.handlerChirpsGetId)
+	router.With(cfg.middlewareAuth).Post("/api/chirps/{chirpID}/reports", cfg.handlerChirpsReport)
+	target := fmt.Sprintf("/api/chirps/%d/reports", chirp.ID)
+
+	steps := []struct {
+		name     string
+		target   string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{"anonymous", target, "", `{"reason":"spam"}`, http.StatusUnauthorized},
+		{"unknown reason", target, tokens[0], `{"reason":"boring"}`, http.StatusBadRequest},
+		{"details too long", target, tokens[0], `{"reason":"spam","details":"` + strings.Repeat("x", 501) + `"}`, http.StatusBadRequest},
+		{"own chirp", target, accessToken(t, cfg, author.ID), `{"reason":"spam"}`, http.StatusBadRequest},
+		{"unknown chirp", "/api/chirps/99/reports", tokens[0], `{"reason":"spam"}`, http.StatusNotFound},
+		{"report", target, tokens[0], `{"reason":"spam","details":"ads"}`, http.StatusCreated},
+		{"report again", target, tokens[0], `{"reason":"other"}`, http.StatusConflict},
+		{"still visible", fmt.Sprintf("/api/chirps/%d", chirp.ID), "", "", http.StatusOK},
+		// The second report reaches the threshold and hides the chirp.
+		{"second report", target, tokens[1], `{"reason":"spam"}`, http.StatusCreated},
+		{"hidden", fmt.Sprintf("/api/chirps/%d", chirp.ID), "", "", http.StatusNotFound},
+		{"report hidden chirp", target, tokens[2], `{"reason":"spam"}`, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		method := "POST"
+		if step.token == "" && step.body == "" {
+			method = "GET"
+		}
+		w := serve(router, method, step.target, step.body, bearer(step.token))
+		if w.Code != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantCode, w.Body)
+		}
+		if step.name == "report" {
+			got := reportResponse{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ChirpID != chirp.ID || got.Reason != "spam" || got.Details != "ads" {
+				t.Errorf("report = %+v, want spam about chirp %d", got, chirp.ID)
+			}
+		}
+	}
+}
+
+func TestHandlerAdminReports(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.reportsToHide = 0
+	router, modToken := newModerationRouter(t, cfg)
+
+	author, err := cfg.DB.CreateUser("author@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("spam", author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportTarget := fmt.Sprintf("/api/chirps/%d/reports", chirp.ID)
+	if code := serve(router, "POST", reportTarget, `{"reason":"spam"}`, bearer(accessToken(t, cfg, reporter.ID))).Code; code != http.StatusCreated {
+		t.Fatalf("report: status = %d, want %d", code, http.StatusCreated)
+	}
+
+	for _, query := range []string{"status=bogus", "reason=boring", "chirp_id=x", "limit=0"} {
+		if code := serve(router, "GET", "/admin/reports?"+query, "", bearer(modToken)).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+	w := serve(router, "GET", "/admin/reports", "", bearer(modToken))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	reports := []Report{}
+	err = json.NewDecoder(w.Body).Decode(&reports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].ReporterID != reporter.ID || reports[0].Chirp == nil || reports[0].Chirp.Body != "spam" {
+		t.Fatalf("reports = %+v, want the report with its chirp", reports)
+	}
+
+	resolve := fmt.Sprintf("/admin/chirps/%d/reports/resolve", chirp.ID)
+	steps := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"unknown resolution", `{"resolution":"ignored"}`, http.StatusBadRequest},
+		{"hide without note", `{"resolution":"hidden"}`, http.StatusBadRequest},
+		{"hide", `{"resolution":"hidden","note":"spam"}`, http.StatusOK},
+		{"nothing open", `{"resolution":"dismissed"}`, http.StatusConflict},
+	}
+	for _, step := range steps {
+		w := serve(router, "POST", resolve, step.body, bearer(modToken))
+		if w.Code != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantCode, w.Body)
+		}
+	}
+	got, err := cfg.DB.GetChirpById(chirp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsHidden() {
+		t.Error("chirp isn't hidden after resolving the reports as hidden")
+	}
+	if reports, _, err := cfg.DB.GetReports(database.ReportQuery{}); err != nil || len(reports) != 0 {
+		t.Errorf("%d open reports, %v; want none", len(reports), err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+func (cfg *apiConfig) handlerChirpsRestore(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirpById(chirpid)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+
+	if chirp.AuthorID != caller.UserID {
+		respondWithError(w, http.StatusForbidden, "Can't restore tweet with different author")
+		return
+	}
+
+	chirp, err = cfg.DB.RestoreChirp(chirpid, time.Now().Add(-cfg.restoreWindow))
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	case errors.Is(err, database.ErrNoChange):
+		respondWithError(w, http.StatusConflict, "Chirp is not deleted.")
+		return
+	case errors.Is(err, database.ErrRestoreExpired):
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Chirp{
+		ID:        chirp.ID,
+		Body:      chirp.Body,
+		AuthorID:  chirp.AuthorID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerChirpsRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.restoreWindow = time.Hour
+	author, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.DB.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("chirp", author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Get("/api/chirps/{chirpID}", cfg.handlerChirpsGetId)
+	router.With(cfg.middlewareAuth).Delete("/api/chirps/{chirpID}", cfg.handlerChirpDelete)
+	router.With(cfg.middlewareAuth).Post("/api/chirps/{chirpID}/restore", cfg.handlerChirpsRestore)
+	target := fmt.Sprintf("/api/chirps/%d", chirp.ID)
+	authorToken := accessToken(t, cfg, author.ID)
+
+	steps := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		wantCode int
+	}{
+		{"restore a live chirp", "POST", target + "/restore", authorToken, http.StatusConflict},
+		{"delete", "DELETE", target, authorToken, http.StatusOK},
+		{"get deleted", "GET", target, "", http.StatusGone},
+		{"delete again", "DELETE", target, authorToken, http.StatusGone},
+		{"restore by another user", "POST", target + "/restore", accessToken(t, cfg, other.ID), http.StatusForbidden},
+		{"restore missing chirp", "POST", "/api/chirps/99/restore", authorToken, http.StatusNotFound},
+		{"restore", "POST", target + "/restore", authorToken, http.StatusOK},
+		{"get restored", "GET", target, "", http.StatusOK},
+	}
+	for _, step := range steps {
+		w := serve(router, step.method, step.target, "", bearer(step.token))
+		if w.Code != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantCode, w.Body)
+		}
+	}
+
+	t.Run("window passed", func(t *testing.T) {
+		cfg.restoreWindow = 0
+		code := serve(router, "DELETE", target, "", bearer(authorToken)).Code
+		if code != http.StatusOK {
+			t.Fatalf("delete: status = %d, want %d", code, http.StatusOK)
+		}
+		code = serve(router, "POST", target+"/restore", "", bearer(authorToken)).Code
+		if code != http.StatusGone {
+			t.Errorf("restore: status = %d, want %d", code, http.StatusGone)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ChirpRevision struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (cfg *apiConfig) handlerChirpsRevisions(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirpById(chirpid)
+	if err != nil || chirp.IsHidden() {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+	if chirp.IsDeleted() {
+		respondWithError(w, http.StatusGone, "Chirp was deleted.")
+		return
+	}
+
+	dbRevisions, err := cfg.DB.GetChirpRevisions(chirpid)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve revisions")
+		return
+	}
+
+	revisions := []ChirpRevision{}
+	for _, dbRevision := range dbRevisions {
+		revisions = append(revisions, ChirpRevision{
+			Body:      dbRevision.Body,
+			CreatedAt: dbRevision.CreatedAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, revisions)
+}
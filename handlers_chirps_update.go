@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (cfg *apiConfig) handlerChirpsUpdate(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	chirpid, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID.")
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	cleaned, err := validateChirp(params.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirpById(chirpid)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No chirp found.")
+		return
+	}
+	if chirp.IsDeleted() {
+		respondWithError(w, http.StatusGone, "Chirp was deleted.")
+		return
+	}
+
+	if chirp.AuthorID != caller.UserID {
+		respondWithError(w, http.StatusForbidden, "Can't edit tweet with different author")
+		return
+	}
+	if chirp.IsHidden() {
+		respondWithError(w, http.StatusForbidden, "Chirp was hidden by a moderator.")
+		return
+	}
+
+	chirp, err = cfg.DB.UpdateChirp(chirpid, cleaned)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Chirp{
+		ID:        chirp.ID,
+		Body:      chirp.Body,
+		AuthorID:  chirp.AuthorID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	})
+}
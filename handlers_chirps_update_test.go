@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerChirpsUpdate(t *testing.T) {
+	cfg := newTestConfig(t)
+	author, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.DB.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("first", author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.With(cfg.middlewareAuth).Put("/api/chirps/{chirpID}", cfg.handlerChirpsUpdate)
+	router.Get("/api/chirps/{chirpID}/revisions", cfg.handlerChirpsRevisions)
+	target := fmt.Sprintf("/api/chirps/%d", chirp.ID)
+
+	tests := []struct {
+		name     string
+		target   string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{"other author", target, accessToken(t, cfg, other.ID), `{"body":"stolen"}`, http.StatusForbidden},
+		{"bad token", target, "not-a-token", `{"body":"second"}`, http.StatusUnauthorized},
+		{"missing chirp", "/api/chirps/99", accessToken(t, cfg, author.ID), `{"body":"second"}`, http.StatusNotFound},
+		{"invalid ID", "/api/chirps/x", accessToken(t, cfg, author.ID), `{"body":"second"}`, http.StatusBadRequest},
+		{"too long", target, accessToken(t, cfg, author.ID), fmt.Sprintf(`{"body":"%0141d"}`, 0), http.StatusBadRequest},
+		{"malformed body", target, accessToken(t, cfg, author.ID), `{"body":`, http.StatusBadRequest},
+		{"author", target, accessToken(t, cfg, author.ID), `{"body":"second"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, "PUT", tt.target, tt.body, bearer(tt.token))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			got := Chirp{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Body != "second" || !got.CreatedAt.Equal(chirp.CreatedAt) || got.UpdatedAt.Before(got.CreatedAt) {
+				t.Errorf("response = %+v, want body second created %v", got, chirp.CreatedAt)
+			}
+		})
+	}
+
+	t.Run("revisions", func(t *testing.T) {
+		w := serve(router, "GET", target+"/revisions", "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		revisions := []ChirpRevision{}
+		err := json.NewDecoder(w.Body).Decode(&revisions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 2 || revisions[0].Body != "first" || revisions[1].Body != "second" {
+			t.Errorf("revisions = %+v, want first then second", revisions)
+		}
+		if code := serve(router, "GET", "/api/chirps/99/revisions", "", nil).Code; code != http.StatusNotFound {
+			t.Errorf("revisions of a missing chirp: status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
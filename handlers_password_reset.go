@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
+	"github.com/takacs/go-web/internal/mail"
+)
+
+const passwordResetTTL = time.Hour
+
+// handlerPasswordForgot emails a password reset token to the account with
+// the given email. It responds the same way whether or not the account
+// exists, and the token is stored and sent in the background so the
+// response time doesn't tell either.
+func (cfg *apiConfig) handlerPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(params.Email)
+	if err == nil {
+		go func() {
+			err := cfg.sendPasswordReset(user)
+			if err != nil {
+				log.Printf("Failed to send password reset to user %d: %v", user.ID, err)
+			}
+		}()
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) sendPasswordReset(user database.User) error {
+	token, err := auth.NewRefreshToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	err = cfg.DB.CreatePasswordReset(database.PasswordReset{
+		Hash:      auth.HashRefreshToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your Chirpy account. To choose a new password, send this token to POST /api/password/reset within %d minutes:\n\n%s\n\nIf it wasn't you, ignore this email; your password hasn't changed.",
+			int(passwordResetTTL.Minutes()), token,
+		),
+	})
+}
+
+// handlerPasswordReset sets a new password with a token from
+// handlerPasswordForgot and signs the user out everywhere.
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password can't be empty.")
+		return
+	}
+
+	user, err := cfg.DB.ResetPassword(auth.HashRefreshToken(params.Token), params.Password)
+	if errors.Is(err, database.ErrResetTokenInvalid) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset password")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, User{
+		ID:              user.ID,
+		Email:           user.Email,
+		IsEmailVerified: user.EmailVerified,
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerPasswordReset(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgot := http.HandlerFunc(cfg.handlerPasswordForgot)
+	reset := func(token, password string) int {
+		body := fmt.Sprintf(`{"token":%q,"password":%q}`, token, password)
+		return serve(http.HandlerFunc(cfg.handlerPasswordReset), "POST", "/api/password/reset", body, nil).Code
+	}
+	session := login(t, cfg, "a@example.com", "password")
+
+	// Unknown emails get the same response and no mail.
+	if code := serve(forgot, "POST", "/api/password/forgot", `{"email":"nobody@example.com"}`, nil).Code; code != http.StatusAccepted {
+		t.Errorf("unknown email: status = %d, want %d", code, http.StatusAccepted)
+	}
+	if code := serve(forgot, "POST", "/api/password/forgot", `{"email":"a@example.com"}`, nil).Code; code != http.StatusAccepted {
+		t.Fatalf("forgot: status = %d, want %d", code, http.StatusAccepted)
+	}
+	msg := nextMail(t, cfg)
+	if msg.To != "a@example.com" {
+		t.Fatalf("reset mail sent to %q, want a@example.com", msg.To)
+	}
+	lines := strings.Split(strings.TrimSpace(msg.Body), "\n\n")
+	if len(lines) < 2 {
+		t.Fatalf("no token in reset mail %q", msg.Body)
+	}
+	token := lines[1]
+
+	if code := reset(token, ""); code != http.StatusBadRequest {
+		t.Errorf("empty password: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := reset("wrong", "new-password"); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := reset(token, "new-password"); code != http.StatusOK {
+		t.Fatalf("reset: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := reset(token, "another-password"); code != http.StatusUnauthorized {
+		t.Errorf("reused token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if _, err := cfg.DB.AuthorizeUser("a@example.com", "new-password"); err != nil {
+		t.Errorf("can't log in with the new password: %v", err)
+	}
+	code := serve(http.HandlerFunc(cfg.handlerTokenRefresh), "POST", "/api/refresh", "", bearer(session.RefreshToken)).Code
+	if code != http.StatusUnauthorized {
+		t.Errorf("refresh token from before the reset: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	sessions, err := cfg.DB.GetSessions(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions survived the reset, want 0", len(sessions))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+const (
+	polkaUserUpgraded   = "user.upgraded"
+	polkaUserDowngraded = "user.downgraded"
+)
+
+type polkaEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserID int `json:"user_id"`
+	} `json:"data"`
+}
+
+func (cfg *apiConfig) handlerPolkaWebhooks(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read body")
+		return
+	}
+
+	err = cfg.verifyPolkaRequest(r, payload)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	event := polkaEvent{}
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	// The ID is what makes redeliveries safe to apply; without it a replay
+	// would be applied again.
+	if event.ID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing event id")
+		return
+	}
+
+	if event.Event != polkaUserUpgraded && event.Event != polkaUserDowngraded {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = cfg.DB.ProcessChirpyRedEvent(event.ID, event.Data.UserID, event.Event == polkaUserUpgraded)
+	if errors.Is(err, database.ErrEventProcessed) {
+		log.Printf("Polka event %s already processed.", event.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process event")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyPolkaRequest accepts a request if it carries the configured API key
+// and, when a webhook secret is set, a valid HMAC-SHA256 of the raw body.
+func (cfg *apiConfig) verifyPolkaRequest(r *http.Request, payload []byte) error {
+	if cfg.polkaKey == "" && cfg.polkaSecret == "" {
+		return errors.New("Polka webhooks are not configured.")
+	}
+
+	if cfg.polkaKey != "" {
+		key, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+		if !found || !hmac.Equal([]byte(key), []byte(cfg.polkaKey)) {
+			return errors.New("Invalid API key.")
+		}
+	}
+
+	if cfg.polkaSecret != "" {
+		signature, err := hex.DecodeString(r.Header.Get("X-Polka-Signature"))
+		if err != nil {
+			return errors.New("Malformed signature.")
+		}
+		mac := hmac.New(sha256.New, []byte(cfg.polkaSecret))
+		mac.Write(payload)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("Invalid signature.")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signPolka(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyPolkaRequest(t *testing.T) {
+	const payload = `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`
+
+	tests := []struct {
+		name      string
+		key       string
+		secret    string
+		apiKey    string
+		signature string
+		ok        bool
+	}{
+		{name: "not configured"},
+		{name: "api key", key: "k", apiKey: "ApiKey k", ok: true},
+		{name: "wrong api key", key: "k", apiKey: "ApiKey x"},
+		{name: "missing api key", key: "k"},
+		{name: "api key without scheme", key: "k", apiKey: "k"},
+		{name: "signature", secret: "s", signature: signPolka("s", payload), ok: true},
+		{name: "uppercase hex signature", secret: "s", signature: strings.ToUpper(signPolka("s", payload)), ok: true},
+		{name: "signed with another secret", secret: "s", signature: signPolka("x", payload)},
+		{name: "signature of another body", secret: "s", signature: signPolka("s", payload+" ")},
+		{name: "truncated signature", secret: "s", signature: signPolka("s", payload)[:32]},
+		{name: "malformed signature", secret: "s", signature: "zz"},
+		{name: "missing signature", secret: "s"},
+		{name: "key and signature", key: "k", secret: "s", apiKey: "ApiKey k", signature: signPolka("s", payload), ok: true},
+		{name: "signature without key", key: "k", secret: "s", signature: signPolka("s", payload)},
+		{name: "key without signature", key: "k", secret: "s", apiKey: "ApiKey k"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{polkaKey: tt.key, polkaSecret: tt.secret}
+			r := httptest.NewRequest("POST", "/api/polka/webhooks", strings.NewReader(payload))
+			if tt.apiKey != "" {
+				r.Header.Set("Authorization", tt.apiKey)
+			}
+			if tt.signature != "" {
+				r.Header.Set("X-Polka-Signature", tt.signature)
+			}
+
+			err := cfg.verifyPolkaRequest(r, []byte(payload))
+			if (err == nil) != tt.ok {
+				t.Errorf("verifyPolkaRequest() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandlerPolkaWebhooks(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.polkaSecret = "s"
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(cfg.handlerPolkaWebhooks)
+	send := func(body string) int {
+		header := http.Header{"X-Polka-Signature": {signPolka("s", body)}}
+		return serve(handler, "POST", "/api/polka/webhooks", body, header).Code
+	}
+	event := func(id, name string, userID int) string {
+		return fmt.Sprintf(`{"id":%q,"event":%q,"data":{"user_id":%d}}`, id, name, userID)
+	}
+	isRed := func() bool {
+		user, err := cfg.DB.AuthorizeUser("a@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.IsChirpyRed
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantRed  bool
+	}{
+		{"upgrade", event("evt_1", polkaUserUpgraded, user.ID), http.StatusNoContent, true},
+		{"downgrade", event("evt_2", polkaUserDowngraded, user.ID), http.StatusNoContent, false},
+		{"redelivered upgrade", event("evt_1", polkaUserUpgraded, user.ID), http.StatusNoContent, false},
+		{"other event", event("evt_3", "user.deleted", user.ID), http.StatusNoContent, false},
+		{"unknown user", event("evt_4", polkaUserUpgraded, 99), http.StatusNotFound, false},
+		{"malformed body", `{"id":`, http.StatusBadRequest, false},
+		{"missing id", event("", polkaUserUpgraded, user.ID), http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := send(tt.body); code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if red := isRed(); red != tt.wantRed {
+				t.Errorf("is_chirpy_red = %v, want %v", red, tt.wantRed)
+			}
+		})
+	}
+
+	t.Run("replay after pruning", func(t *testing.T) {
+		_, err := cfg.DB.PruneTokens(time.Now(), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := send(event("evt_1", polkaUserUpgraded, user.ID)); code != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", code, http.StatusNoContent)
+		}
+		if isRed() {
+			t.Error("replayed upgrade was applied")
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		body := event("evt_5", polkaUserUpgraded, user.ID)
+		header := http.Header{"X-Polka-Signature": {signPolka("x", body)}}
+		code := serve(handler, "POST", "/api/polka/webhooks", body, header).Code
+		if code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if isRed() {
+			t.Error("unsigned upgrade was applied")
+		}
+	})
+}
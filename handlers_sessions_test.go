@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerSessions(t *testing.T) {
+	cfg := newTestConfig(t)
+	a, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.DB.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Post("/api/refresh", cfg.handlerTokenRefresh)
+	router.Group(func(r chi.Router) {
+		r.Use(cfg.middlewareAuth)
+		r.Get("/api/sessions", cfg.handlerSessionsList)
+		r.Delete("/api/sessions/{sessionID}", cfg.handlerSessionsRevoke)
+		r.Post("/api/sessions/revoke-all", cfg.handlerSessionsRevokeAll)
+	})
+	first := login(t, cfg, "a@example.com", "password")
+	second := login(t, cfg, "a@example.com", "password")
+	other := login(t, cfg, "b@example.com", "password")
+	token := first.Token
+	list := func() []sessionResponse {
+		t.Helper()
+		w := serve(router, "GET", "/api/sessions", "", bearer(token))
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: status = %d, want %d", w.Code, http.StatusOK)
+		}
+		sessions := []sessionResponse{}
+		err := json.NewDecoder(w.Body).Decode(&sessions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessions
+	}
+	refreshCode := func(refreshToken string) int {
+		return serve(router, "POST", "/api/refresh", "", bearer(refreshToken)).Code
+	}
+
+	sessions := list()
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+	if sessions[0].IP != "192.0.2.1" {
+		t.Errorf("session IP = %q, want the client address", sessions[0].IP)
+	}
+
+	// Revoking a session stops both its refresh and its access tokens.
+	code := serve(router, "DELETE", "/api/sessions/"+sessionOf(t, cfg, second.Token), "", bearer(token)).Code
+	if code != http.StatusOK {
+		t.Fatalf("revoke: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := refreshCode(second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh of the revoked session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(router, "GET", "/api/sessions", "", bearer(second.Token)).Code; code != http.StatusUnauthorized {
+		t.Errorf("access token of the revoked session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := refreshCode(first.RefreshToken); code != http.StatusOK {
+		t.Errorf("refresh of the kept session: status = %d, want %d", code, http.StatusOK)
+	}
+	if len(list()) != 1 {
+		t.Error("revoked session is still listed")
+	}
+
+	otherSessions, err := cfg.DB.GetSessions(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = serve(router, "DELETE", "/api/sessions/"+otherSessions[0].ID, "", bearer(token)).Code
+	if code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	w := serve(router, "POST", "/api/sessions/revoke-all", "", bearer(token))
+	if w.Code != http.StatusOK || w.Body.String() != `{"revoked":1}` {
+		t.Errorf("revoke-all = %d %s, want 200 {\"revoked\":1}", w.Code, w.Body)
+	}
+	if code := serve(router, "GET", "/api/sessions", "", bearer(token)).Code; code != http.StatusUnauthorized {
+		t.Errorf("access token after revoke-all: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if sessions, err := cfg.DB.GetSessions(a.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("%d sessions still listed after revoke-all, %v", len(sessions), err)
+	}
+	if code := refreshCode(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("other user's session after revoke-all: status = %d, want %d", code, http.StatusOK)
+	}
+}
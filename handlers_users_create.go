@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/mail"
 )
 
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
+	ID              int    `json:"id"`
+	Email           string `json:"email"`
+	IsEmailVerified bool   `json:"is_email_verified"`
 }
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
@@ -26,14 +30,40 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = validateEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	user, err := cfg.DB.CreateUser(params.Email, params.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create email.")
 		return
 	}
 
+	// The account exists either way; the user can ask for a new link. The
+	// mail goes out in the background so a slow mail server doesn't hold up
+	// the response.
+	go func() {
+		err := cfg.sendVerification(user)
+		if err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}()
+
 	respondWithJSON(w, http.StatusCreated, User{
-		ID:    user.ID,
-		Email: user.Email,
+		ID:              user.ID,
+		Email:           user.Email,
+		IsEmailVerified: user.EmailVerified,
 	})
 }
+
+// validateEmail accepts a bare address such as "name@example.com".
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("Invalid email address.")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+// handlerUsersDelete permanently deletes the caller's account with all of
+// their chirps and sessions. The password must be confirmed.
+func (cfg *apiConfig) handlerUsersDelete(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	err = cfg.DB.DeleteUser(caller.UserID, params.Password)
+	if errors.Is(err, database.ErrInvalidCredentials) {
+		respondWithError(w, http.StatusUnauthorized, "Password is incorrect.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete account")
+		return
+	}
+
+	if caller.TokenID != "" {
+		err = cfg.DB.DenyToken(caller.TokenID, caller.ExpiresAt)
+		if err != nil {
+			log.Printf("Failed to revoke access token of deleted user %d: %v", caller.UserID, err)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+func TestHandlerUsersExport(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := cfg.DB.CreateChirp("chirp", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := login(t, cfg, "a@example.com", "password")
+	export := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersExport))
+	_, err = cfg.DB.ModerateChirp(database.ModerationEntry{ModeratorID: 99, Action: database.ActionHideChirp, ChirpID: chirp.ID, Reason: "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := serve(export, "GET", "/api/users/me/export?format=xml", "", bearer(session.Token)).Code; code != http.StatusBadRequest {
+		t.Errorf("unknown format: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	w := serve(export, "GET", "/api/users/me/export", "", bearer(session.Token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("json: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	got := userExport{}
+	err = json.NewDecoder(w.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User.Email != "a@example.com" || len(got.Chirps) != 1 || len(got.Sessions) != 1 || len(got.RefreshTokens) != 1 {
+		t.Errorf("export = %+v, want the user with one chirp and one session", got)
+	}
+	if got.Chirps[0].HiddenAt == nil || got.Chirps[0].HiddenReason != "spam" {
+		t.Errorf("exported chirp = %+v, want hidden for spam", got.Chirps[0])
+	}
+	if len(got.ModerationLog) != 1 || got.ModerationLog[0].Action != "hide_chirp" {
+		t.Errorf("exported moderation log = %+v, want the hide", got.ModerationLog)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("$2a$")) {
+		t.Error("export contains a password hash")
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("moderator")) {
+		t.Error("export names the moderator")
+	}
+
+	w = serve(export, "GET", "/api/users/me/export?format=zip", "", bearer(session.Token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, f := range archive.File {
+		names[f.Name] = true
+	}
+	for _, name := range []string{"user.json", "chirps.json", "chirp_revisions.json", "sessions.json", "refresh_tokens.json", "password_resets.json", "reports.json", "moderation_log.json"} {
+		if !names[name] {
+			t.Errorf("archive has no %s", name)
+		}
+	}
+}
+
+func TestHandlerUsersDelete(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := login(t, cfg, "a@example.com", "password")
+	other := login(t, cfg, "a@example.com", "password")
+	remove := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersDelete))
+
+	if code := serve(remove, "DELETE", "/api/users", `{"password":`, bearer(session.Token)).Code; code != http.StatusBadRequest {
+		t.Errorf("malformed body: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := serve(remove, "DELETE", "/api/users", `{"password":"wrong"}`, bearer(session.Token)).Code; code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(remove, "DELETE", "/api/users", `{"password":"password"}`, bearer(session.Token)).Code; code != http.StatusOK {
+		t.Fatalf("delete: status = %d, want %d", code, http.StatusOK)
+	}
+
+	if _, err := cfg.DB.GetUser(user.ID); err == nil {
+		t.Error("user still exists")
+	}
+	// The access token used for the deletion is revoked along with the
+	// account, every other one stops working and the refresh token is gone.
+	if code := serve(remove, "DELETE", "/api/users", `{"password":"password"}`, bearer(session.Token)).Code; code != http.StatusUnauthorized {
+		t.Errorf("reused access token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(remove, "DELETE", "/api/users", `{"password":"password"}`, bearer(other.Token)).Code; code != http.StatusUnauthorized {
+		t.Errorf("other access token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(http.HandlerFunc(cfg.handlerTokenRefresh), "POST", "/api/refresh", "", bearer(session.RefreshToken)).Code; code != http.StatusUnauthorized {
+		t.Errorf("refresh: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
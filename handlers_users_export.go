@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+// userExport is everything Chirpy stores about a user. Password and token
+// hashes are left out: they are secrets, not data about the user. So is
+// which moderator took an action, to protect moderators from retaliation.
+type userExport struct {
+	ExportedAt     time.Time             `json:"exported_at"`
+	User           exportUser            `json:"user"`
+	Chirps         []exportChirp         `json:"chirps"`
+	ChirpRevisions []exportRevision      `json:"chirp_revisions"`
+	Sessions       []exportSession       `json:"sessions"`
+	RefreshTokens  []exportRefreshToken  `json:"refresh_tokens"`
+	PasswordResets []exportPasswordReset `json:"password_resets"`
+	Reports        []exportReport        `json:"reports"`
+	ModerationLog  []exportModeration    `json:"moderation_log"`
+}
+
+type exportUser struct {
+	ID              int        `json:"id"`
+	Email           string     `json:"email"`
+	IsChirpyRed     bool       `json:"is_chirpy_red"`
+	IsEmailVerified bool       `json:"is_email_verified"`
+	DisplayName     string     `json:"display_name"`
+	Bio             string     `json:"bio"`
+	AvatarURL       string     `json:"avatar_url"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	Role            string     `json:"role"`
+	SuspendedAt     *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason string     `json:"suspended_reason,omitempty"`
+}
+
+type exportChirp struct {
+	ID           int        `json:"id"`
+	Body         string     `json:"body"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	HiddenAt     *time.Time `json:"hidden_at,omitempty"`
+	HiddenReason string     `json:"hidden_reason,omitempty"`
+}
+
+type exportRevision struct {
+	ChirpID   int       `json:"chirp_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportSession struct {
+	ID         string     `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type exportRefreshToken struct {
+	SessionID string     `json:"session_id"`
+	DeviceID  string     `json:"device_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type exportPasswordReset struct {
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type exportReport struct {
+	ChirpID    int        `json:"chirp_id"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+type exportModeration struct {
+	Action    string    `json:"action"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// handlerUsersExport sends the caller an archive of their data: one JSON
+// document by default, or a ZIP of one JSON file per collection with
+// ?format=zip.
+func (cfg *apiConfig) handlerUsersExport(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		respondWithError(w, http.StatusBadRequest, "Invalid format.")
+		return
+	}
+
+	data, err := cfg.DB.ExportUser(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	export := newUserExport(data)
+
+	filename := fmt.Sprintf("chirpy-export-%d", caller.UserID)
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+		err = writeExportZip(w, export)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(export)
+	}
+	if err != nil {
+		// Headers are already sent; all we can do is log.
+		log.Printf("Failed to write export for user %d: %v", caller.UserID, err)
+	}
+}
+
+func writeExportZip(w http.ResponseWriter, export userExport) error {
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"user.json", struct {
+			ExportedAt time.Time  `json:"exported_at"`
+			User       exportUser `json:"user"`
+		}{export.ExportedAt, export.User}},
+		{"chirps.json", export.Chirps},
+		{"chirp_revisions.json", export.ChirpRevisions},
+		{"sessions.json", export.Sessions},
+		{"refresh_tokens.json", export.RefreshTokens},
+		{"password_resets.json", export.PasswordResets},
+		{"reports.json", export.Reports},
+		{"moderation_log.json", export.ModerationLog},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.content)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func newUserExport(data database.UserData) userExport {
+	export := userExport{
+		ExportedAt: time.Now().UTC(),
+		User: exportUser{
+			ID:              data.User.ID,
+			Email:           data.User.Email,
+			IsChirpyRed:     data.User.IsChirpyRed,
+			IsEmailVerified: data.User.EmailVerified,
+			DisplayName:     data.User.DisplayName,
+			Bio:             data.User.Bio,
+			AvatarURL:       data.User.AvatarURL,
+			CreatedAt:       optionalTime(data.User.CreatedAt),
+			Role:            string(data.User.Role),
+			SuspendedAt:     optionalTime(data.User.SuspendedAt),
+			SuspendedReason: data.User.SuspendedReason,
+		},
+		Chirps:         []exportChirp{},
+		ChirpRevisions: []exportRevision{},
+		Sessions:       []exportSession{},
+		RefreshTokens:  []exportRefreshToken{},
+		PasswordResets: []exportPasswordReset{},
+		Reports:        []exportReport{},
+		ModerationLog:  []exportModeration{},
+	}
+	for _, chirp := range data.Chirps {
+		export.Chirps = append(export.Chirps, exportChirp{
+			ID:           chirp.ID,
+			Body:         chirp.Body,
+			CreatedAt:    chirp.CreatedAt,
+			UpdatedAt:    chirp.UpdatedAt,
+			DeletedAt:    optionalTime(chirp.DeletedAt),
+			HiddenAt:     optionalTime(chirp.HiddenAt),
+			HiddenReason: chirp.HiddenReason,
+		})
+	}
+	for _, revision := range data.ChirpRevisions {
+		export.ChirpRevisions = append(export.ChirpRevisions, exportRevision{
+			ChirpID:   revision.ChirpID,
+			Body:      revision.Body,
+			CreatedAt: revision.CreatedAt,
+		})
+	}
+	for _, session := range data.Sessions {
+		export.Sessions = append(export.Sessions, exportSession{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			RevokedAt:  optionalTime(session.RevokedAt),
+		})
+	}
+	for _, token := range data.RefreshTokens {
+		export.RefreshTokens = append(export.RefreshTokens, exportRefreshToken{
+			SessionID: token.FamilyID,
+			DeviceID:  token.DeviceID,
+			CreatedAt: token.CreatedAt,
+			ExpiresAt: token.ExpiresAt,
+			RotatedAt: optionalTime(token.RotatedAt),
+			RevokedAt: optionalTime(token.RevokedAt),
+		})
+	}
+	for _, reset := range data.PasswordResets {
+		export.PasswordResets = append(export.PasswordResets, exportPasswordReset{
+			CreatedAt: reset.CreatedAt,
+			ExpiresAt: reset.ExpiresAt,
+			UsedAt:    optionalTime(reset.UsedAt),
+		})
+	}
+	for _, report := range data.Reports {
+		export.Reports = append(export.Reports, exportReport{
+			ChirpID:    report.ChirpID,
+			Reason:     string(report.Reason),
+			Details:    report.Details,
+			CreatedAt:  report.CreatedAt,
+			ResolvedAt: optionalTime(report.ResolvedAt),
+			Resolution: string(report.Resolution),
+		})
+	}
+	for _, entry := range data.ModerationLog {
+		export.ModerationLog = append(export.ModerationLog, exportModeration{
+			Action:    string(entry.Action),
+			ChirpID:   entry.ChirpID,
+			Reason:    entry.Reason,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	return export
+}
+
+// optionalTime is nil for the zero time, so unset timestamps are omitted.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+// Profile is what anyone can see about a user.
+type Profile struct {
+	ID          int        `json:"id"`
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"`
+	AvatarURL   string     `json:"avatar_url"`
+	ChirpCount  int        `json:"chirp_count"`
+	JoinedAt    *time.Time `json:"joined_at,omitempty"`
+}
+
+// SelfProfile is the caller's own profile, with the private fields.
+type SelfProfile struct {
+	Profile
+	Email           string `json:"email"`
+	IsChirpyRed     bool   `json:"is_chirpy_red"`
+	IsEmailVerified bool   `json:"is_email_verified"`
+	Role            string `json:"role"`
+}
+
+func (cfg *apiConfig) handlerUsersMe(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	profile, err := cfg.selfProfile(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get profile")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func (cfg *apiConfig) handlerUsersGetId(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid User ID.")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	profile, err := cfg.profile(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get profile")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func (cfg *apiConfig) profile(user database.User) (Profile, error) {
+	count, err := cfg.DB.CountChirps(user.ID)
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{
+		ID:          user.ID,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		ChirpCount:  count,
+		JoinedAt:    optionalTime(user.CreatedAt),
+	}, nil
+}
+
+func (cfg *apiConfig) selfProfile(user database.User) (SelfProfile, error) {
+	profile, err := cfg.profile(user)
+	if err != nil {
+		return SelfProfile{}, err
+	}
+	return SelfProfile{
+		Profile:         profile,
+		Email:           user.Email,
+		IsChirpyRed:     user.IsChirpyRed,
+		IsEmailVerified: user.EmailVerified,
+		Role:            string(user.Role),
+	}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+func TestHandlerUsersProfile(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, bio := "Ann", "Hi"
+	_, err = cfg.DB.UpdateUser(user.ID, database.UserUpdate{DisplayName: &name, Bio: &bio})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"kept", "deleted"} {
+		chirp, err := cfg.DB.CreateChirp(body, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body == "deleted" {
+			err = cfg.DB.DeleteChirp(chirp.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	router := chi.NewRouter()
+	router.With(cfg.middlewareAuth).Get("/api/users/me", cfg.handlerUsersMe)
+	router.Get("/api/users/{userID}", cfg.handlerUsersGetId)
+
+	t.Run("me", func(t *testing.T) {
+		if code := serve(router, "GET", "/api/users/me", "", nil).Code; code != http.StatusUnauthorized {
+			t.Errorf("anonymous: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		w := serve(router, "GET", "/api/users/me", "", bearer(accessToken(t, cfg, user.ID)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		got := SelfProfile{}
+		err := json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.Email != "a@example.com" || got.DisplayName != "Ann" || got.ChirpCount != 1 || got.JoinedAt == nil {
+			t.Errorf("profile = %+v, want Ann with one chirp", got)
+		}
+	})
+
+	t.Run("public", func(t *testing.T) {
+		w := serve(router, "GET", fmt.Sprintf("/api/users/%d", user.ID), "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if bytes.Contains(w.Body.Bytes(), []byte("a@example.com")) {
+			t.Errorf("public profile shows the email: %s", w.Body)
+		}
+		got := Profile{}
+		err := json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.DisplayName != "Ann" || got.Bio != "Hi" || got.ChirpCount != 1 {
+			t.Errorf("profile = %+v, want Ann with one chirp", got)
+		}
+		if code := serve(router, "GET", "/api/users/99", "", nil).Code; code != http.StatusNotFound {
+			t.Errorf("unknown user: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := serve(router, "GET", "/api/users/x", "", nil).Code; code != http.StatusBadRequest {
+			t.Errorf("invalid ID: status = %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+}
@@ -2,25 +2,35 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
 )
 
-const (
-	Access  string = "chirpy-access"
-	Refresh        = "chirpy-refresh"
-)
+const Access string = "chirpy-access"
+
+var errAccountSuspended = errors.New("Account is suspended.")
+
+// refreshTokenTTL is how long a refresh token stays usable. Every refresh
+// issues a new token with a fresh TTL.
+const refreshTokenTTL = 60 * 24 * time.Hour
 
 type loginResponse struct {
-	ID           int    `json:"id"`
-	Email        string `json:"email"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	ID              int    `json:"id"`
+	Email           string `json:"email"`
+	Token           string `json:"token"`
+	RefreshToken    string `json:"refresh_token"`
+	IsChirpyRed     bool   `json:"is_chirpy_red"`
+	IsEmailVerified bool   `json:"is_email_verified"`
+	Role            string `json:"role"`
 }
 
 func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request) {
@@ -40,55 +50,136 @@ func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// The attempt is reserved before the password is checked, so parallel
+	// guesses are throttled like sequential ones.
+	account := strings.ToLower(strings.TrimSpace(params.Email))
+	ip := clientIP(r)
+	wait, ipLockedOut := cfg.loginIPs.Acquire(ip)
+	accountLockedOut := false
+	if wait == 0 {
+		wait, accountLockedOut = cfg.loginAccounts.Acquire(account)
+		if wait > 0 {
+			cfg.loginIPs.Release(ip)
+		}
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts. Try again later.")
+		return
+	}
+
 	user, err := cfg.DB.AuthorizeUser(params.Email, params.Password)
-	if err != nil {
+	if errors.Is(err, database.ErrInvalidCredentials) {
+		if accountLockedOut {
+			log.Printf("Locking out logins for an account after repeated failures.")
+		}
+		if ipLockedOut {
+			log.Printf("Locking out logins from %s after repeated failures.", ip)
+		}
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
+	if err != nil {
+		cfg.loginAccounts.Release(account)
+		cfg.loginIPs.Release(ip)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't log in")
+		return
+	}
+	// Other users may share the IP, so a success only gives back its own
+	// attempt there.
+	cfg.loginAccounts.Reset(account)
+	cfg.loginIPs.Release(ip)
+	if user.IsSuspended() {
+		respondWithError(w, http.StatusForbidden, errAccountSuspended.Error())
+		return
+	}
 
-	token, err := cfg.createJwt(user.ID, Access)
+	sessionID, err := auth.RandomString(16)
 	if err != nil {
-		log.Print(cfg.jwt)
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session")
 		return
 	}
-	refresh_token, err := cfg.createJwt(user.ID, Refresh)
+	token, err := cfg.createJwt(user, sessionID)
 	if err != nil {
-		log.Print(cfg.jwt)
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	err = cfg.DB.SaveRefreshToken(refresh_token)
+	refresh_token, stored, err := newRefreshToken(r.Header.Get("X-Device-ID"))
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+		return
+	}
+	err = cfg.DB.CreateSession(database.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+		CreatedAt:  stored.CreatedAt,
+		LastUsedAt: stored.CreatedAt,
+		ExpiresAt:  stored.ExpiresAt,
+	}, stored)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save session")
+		return
 	}
 	respondWithJSON(w, http.StatusOK, loginResponse{
-		Email:        params.Email,
-		ID:           user.ID,
-		Token:        token,
-		RefreshToken: refresh_token,
-		IsChirpyRed:  user.IsChirpyRed,
+		Email:           params.Email,
+		ID:              user.ID,
+		Token:           token,
+		RefreshToken:    refresh_token,
+		IsChirpyRed:     user.IsChirpyRed,
+		IsEmailVerified: user.EmailVerified,
+		Role:            string(user.Role),
 	})
 }
 
-func (cfg *apiConfig) createJwt(id int, issuer string) (string, error) {
-	idasstring := strconv.Itoa(id)
+// accessClaims are the claims of an access token. SessionID names the login
+// the token was issued for and Role the user's role when it was issued.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionID string        `json:"sid,omitempty"`
+	Role      database.Role `json:"role,omitempty"`
+}
+
+// createJwt issues an access token for a user's session.
+func (cfg *apiConfig) createJwt(user database.User, sessionID string) (string, error) {
+	idasstring := strconv.Itoa(user.ID)
 	expires := time.Hour
-	if issuer == "chirpy-refresh" {
-		expires = 60 * 24 * time.Hour
+	jti, err := auth.RandomString(16)
+	if err != nil {
+		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    issuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
-		Subject:   idasstring,
+	signedToken, err := cfg.keys.Sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    Access,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
+			Subject:   idasstring,
+		},
+		SessionID: sessionID,
+		Role:      user.Role,
 	})
-
-	signedToken, err := token.SignedString([]byte(cfg.jwt))
-
 	if err != nil {
 		return "", err
 	}
 
 	return signedToken, nil
 }
+
+// newRefreshToken returns a new opaque refresh token and the record to store
+// for it. The store fills in the user and family. deviceID comes from the
+// X-Device-ID header, both at login and at refresh.
+func newRefreshToken(deviceID string) (string, database.RefreshToken, error) {
+	token, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", database.RefreshToken{}, err
+	}
+	now := time.Now().UTC()
+	return token, database.RefreshToken{
+		Hash:      auth.HashRefreshToken(token),
+		DeviceID:  deviceID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestHandlerUsersLoginThrottle(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(cfg.handlerUsersLogin)
+	attempt := func(email, password string) (int, string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"email":%q,"password":%q}`, email, password)
+		r := serve(handler, "POST", "/api/login", body, nil)
+		resp := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&resp)
+		return r.Code, resp.Error
+	}
+
+	// Unknown emails and wrong passwords fail the same way.
+	_, unknown := attempt("nobody@example.com", "password")
+	_, wrong := attempt("a@example.com", "wrong")
+	if unknown != wrong {
+		t.Errorf("unknown email error %q differs from wrong password error %q", unknown, wrong)
+	}
+	cfg.loginAccounts.Reset("a@example.com")
+	cfg.loginIPs.Reset("192.0.2.1")
+
+	// The test config allows three free failures per account.
+	for i := 0; i < 3; i++ {
+		if code, _ := attempt("a@example.com", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+	}
+	code, _ := attempt("A@example.com ", "wrong")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("last free failure: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	r := serve(handler, "POST", "/api/login", `{"email":"a@example.com","password":"password"}`, nil)
+	if r.Code != http.StatusTooManyRequests || r.Header().Get("Retry-After") == "" {
+		t.Errorf("throttled login: status = %d, Retry-After %q; want %d with Retry-After",
+			r.Code, r.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	cfg.loginAccounts.Reset("a@example.com")
+	cfg.loginIPs.Reset("192.0.2.1")
+	if code, _ := attempt("a@example.com", "password"); code != http.StatusOK {
+		t.Errorf("login after the throttle was reset: status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -1,72 +1,61 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
-	"strings"
-	"strconv"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
 )
 
 type refreshResponse struct {
-	RefreshToken string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
+// handlerTokenRefresh exchanges a refresh token for a new access token and
+// a new refresh token. The presented token can't be used again; if it is,
+// every token from the same login is revoked.
 func (cfg *apiConfig) handlerTokenRefresh(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
 
-	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(cfg.jwt), nil },
-	)
-
+	tokenString, err := bearerToken(r)
 	if err != nil {
-		log.Print(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	refreshToken, next, err := newRefreshToken(r.Header.Get("X-Device-ID"))
 	if err != nil {
-		log.Print(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
 		return
 	}
-
-	if issuer != Refresh {
-		respondWithError(w, http.StatusBadRequest, "Issuer not Refresh.")
-		return
+	next, err = cfg.DB.RotateRefreshToken(auth.HashRefreshToken(tokenString), next)
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("Refresh token reuse detected; revoked token family.")
 	}
-
-	isvalid, err := cfg.DB.IsRevoked(tokenString)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
-
-	} else if !isvalid {
-		respondWithError(w, http.StatusUnauthorized, "Provided token not valid.")
-		return
 	}
 
-	id, err := token.Claims.GetSubject()
+	user, err := cfg.DB.GetUser(next.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusUnauthorized, "No user found.")
+		return
 	}
-
-	strid, err := strconv.Atoi(id)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	if user.IsSuspended() {
+		respondWithError(w, http.StatusForbidden, errAccountSuspended.Error())
+		return
 	}
-	refreshedAccess, err := cfg.createJwt(strid, Access)
+	accessToken, err := cfg.createJwt(user, next.FamilyID)
 	if err != nil {
-		log.Print(cfg.jwt)
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusOK, refreshResponse{RefreshToken: refreshedAccess})
+	respondWithJSON(w, http.StatusOK, refreshResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
 }
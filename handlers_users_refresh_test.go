@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHandlerTokenRefresh(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func(token string, header http.Header) (int, refreshResponse) {
+		t.Helper()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Authorization", "Bearer "+token)
+		w := serve(http.HandlerFunc(cfg.handlerTokenRefresh), "POST", "/api/refresh", "", header)
+		resp := refreshResponse{}
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+	revoke := func(token string) int {
+		return serve(http.HandlerFunc(cfg.handlerRevokeToken), "POST", "/api/revoke", "", bearer(token)).Code
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		first := login(t, cfg, "a@example.com", "password").RefreshToken
+		code, resp := refresh(first, nil)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if resp.Token == "" || resp.RefreshToken == "" || resp.RefreshToken == first {
+			t.Fatalf("response = %+v, want an access token and a new refresh token", resp)
+		}
+		if code, _ := refresh(first, nil); code != http.StatusUnauthorized {
+			t.Errorf("reusing the old token: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		// Reuse revokes the rest of the family too.
+		if code, _ := refresh(resp.RefreshToken, nil); code != http.StatusUnauthorized {
+			t.Errorf("successor after reuse: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		token := login(t, cfg, "a@example.com", "password").RefreshToken
+		if code := revoke(token); code != http.StatusOK {
+			t.Fatalf("revoke: status = %d, want %d", code, http.StatusOK)
+		}
+		if code, _ := refresh(token, nil); code != http.StatusUnauthorized {
+			t.Errorf("refresh after revoke: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code := revoke("unknown"); code != http.StatusUnauthorized {
+			t.Errorf("revoking an unknown token: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("device", func(t *testing.T) {
+		body := `{"email":"a@example.com","password":"password"}`
+		w := serve(http.HandlerFunc(cfg.handlerUsersLogin), "POST", "/api/login", body, http.Header{"X-Device-ID": {"phone"}})
+		resp := loginResponse{}
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := refresh(resp.RefreshToken, http.Header{"X-Device-ID": {"laptop"}}); code != http.StatusUnauthorized {
+			t.Errorf("other device: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code, _ := refresh(resp.RefreshToken, http.Header{"X-Device-ID": {"phone"}}); code != http.StatusOK {
+			t.Errorf("same device: status = %d, want %d", code, http.StatusOK)
+		}
+	})
+
+	if code, _ := refresh("unknown", nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -1,24 +1,35 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strings"
+
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
 )
 
+// handlerRevokeToken revokes the bearer token. Access tokens (JWTs) are
+// added to the deny-list until they expire; refresh tokens revoke their
+// session.
 func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		respondWithError(w, http.StatusBadRequest, "No auth header")
-	}
-	headers := strings.Split(authHeader, " ")
-	if len(headers) < 2 || headers[0] != "Bearer" {
-		respondWithError(w, http.StatusBadRequest, "malformed authorization header")
+	tokenString, err := bearerToken(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	tokenString := headers[1]
+	if strings.Count(tokenString, ".") == 2 {
+		cfg.revokeAccessToken(w, tokenString)
+		return
+	}
 
-	err := cfg.DB.RevokeToken(tokenString)
+	err = cfg.DB.RevokeRefreshToken(auth.HashRefreshToken(tokenString))
+	if errors.Is(err, database.ErrTokenNotFound) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
 		return
@@ -26,3 +37,22 @@ func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request)
 
 	respondWithJSON(w, http.StatusOK, struct{}{})
 }
+
+func (cfg *apiConfig) revokeAccessToken(w http.ResponseWriter, tokenString string) {
+	caller, err := cfg.parseToken(tokenString, Access)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if caller.TokenID == "" {
+		respondWithError(w, http.StatusBadRequest, "Token has no ID and can't be revoked.")
+		return
+	}
+
+	err = cfg.DB.DenyToken(caller.TokenID, caller.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
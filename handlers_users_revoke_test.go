@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHandlerRevokeAccessToken(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := cfg.middlewareAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	revoke := http.HandlerFunc(cfg.handlerRevokeToken)
+	revoked := accessToken(t, cfg, user.ID)
+	kept := accessToken(t, cfg, user.ID)
+
+	if code := serve(protected, "GET", "/api/users", "", bearer(revoked)).Code; code != http.StatusOK {
+		t.Fatalf("before revoking: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(revoke, "POST", "/api/revoke", "", bearer(revoked)).Code; code != http.StatusOK {
+		t.Fatalf("revoke: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(protected, "GET", "/api/users", "", bearer(revoked)).Code; code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(revoke, "POST", "/api/revoke", "", bearer(revoked)).Code; code != http.StatusUnauthorized {
+		t.Errorf("revoking twice: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(protected, "GET", "/api/users", "", bearer(kept)).Code; code != http.StatusOK {
+		t.Errorf("other token of the same user: status = %d, want %d", code, http.StatusOK)
+	}
+
+	// Tokens issued before jti was added belong to no session and are
+	// rejected; one with a session but no jti can't be revoked.
+	legacy, err := cfg.keys.Sign(jwt.RegisteredClaims{
+		Issuer:    Access,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(protected, "GET", "/api/users", "", bearer(legacy)).Code; code != http.StatusUnauthorized {
+		t.Errorf("token without session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	noJTI, err := cfg.keys.Sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Access,
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		SessionID: sessionOf(t, cfg, kept),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(protected, "GET", "/api/users", "", bearer(noJTI)).Code; code != http.StatusOK {
+		t.Errorf("token without jti: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(revoke, "POST", "/api/revoke", "", bearer(noJTI)).Code; code != http.StatusBadRequest {
+		t.Errorf("revoking a token without jti: status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
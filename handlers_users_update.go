@@ -2,84 +2,125 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
-	"time"
+	"net/url"
+	"unicode/utf8"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/database"
 )
 
-type updateResponse struct {
-	ID    int    `json:"id"`
-	Email string `json:"email"`
-}
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
 
+// handlerUsersUpdate changes the caller's email, password and profile.
+// Omitted fields are left unchanged. Changing the email or password needs
+// current_password and signs the user out of every other session.
 func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request) {
 	logCall(r)
-	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(cfg.jwt), nil },
-	)
-	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
 		return
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	type parameters struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarURL       *string `json:"avatar_url"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-	if issuer == Refresh {
-		respondWithError(w, http.StatusUnauthorized, "Issuer is Refresh.")
+	if params.Email != nil {
+		err = validateEmail(*params.Email)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if params.Password != nil && *params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password can't be empty.")
 		return
 	}
-
-	userIDString, err := token.Claims.GetSubject()
+	err = validateProfile(params.DisplayName, params.Bio, params.AvatarURL)
 	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	expiresAt, err := token.Claims.GetExpirationTime()
+	before, err := cfg.DB.GetUser(caller.UserID)
 	if err != nil {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusNotFound, "No user found.")
 		return
 	}
 
-	if expiresAt.Before(time.Now().UTC()) {
-		log.Printf(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+	user, err := cfg.DB.UpdateUser(caller.UserID, database.UserUpdate{
+		Email:           params.Email,
+		Password:        params.Password,
+		CurrentPassword: params.CurrentPassword,
+		DisplayName:     params.DisplayName,
+		Bio:             params.Bio,
+		AvatarURL:       params.AvatarURL,
+		KeepSession:     caller.SessionID,
+	})
+	if errors.Is(err, database.ErrInvalidCredentials) {
+		respondWithError(w, http.StatusUnauthorized, "Current password is incorrect.")
 		return
 	}
-
-	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
 	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithError(w, http.StatusInternalServerError, "Update Failed")
 		return
 	}
 
-	id, err := strconv.Atoi(userIDString)
-	user, err := cfg.DB.UpdateUser(id, params.Email, params.Password)
+	if user.Email != before.Email {
+		go func() {
+			err := cfg.sendVerification(user)
+			if err != nil {
+				log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+			}
+		}()
+	}
+	profile, err := cfg.selfProfile(user)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Update Failed")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get profile")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+// validateProfile checks the profile fields that are being set. The avatar
+// must be an absolute http(s) URL, or empty to remove it.
+func validateProfile(displayName, bio, avatarURL *string) error {
+	if displayName != nil && utf8.RuneCountInString(*displayName) > maxDisplayNameLength {
+		return fmt.Errorf("Display name can be at most %d characters.", maxDisplayNameLength)
+	}
+	if bio != nil && utf8.RuneCountInString(*bio) > maxBioLength {
+		return fmt.Errorf("Bio can be at most %d characters.", maxBioLength)
+	}
+	if avatarURL != nil && *avatarURL != "" {
+		u, err := url.Parse(*avatarURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			len(*avatarURL) > maxAvatarURLLength {
+			return errors.New("Avatar URL must be an http or https URL.")
+		}
 	}
-	respondWithJSON(w, http.StatusOK, updateResponse{ID: id, Email: user.Email})
+	return nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerUsersUpdate(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.DB.CreateUser("taken@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersUpdate))
+	current := login(t, cfg, "a@example.com", "password")
+	other := login(t, cfg, "a@example.com", "password")
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"malformed body", `{"email":`, http.StatusBadRequest},
+		{"invalid email", `{"email":"nope","current_password":"password"}`, http.StatusBadRequest},
+		{"empty password", `{"password":"","current_password":"password"}`, http.StatusBadRequest},
+		{"no current password", `{"password":"secret"}`, http.StatusUnauthorized},
+		{"wrong current password", `{"password":"secret","current_password":"wrong"}`, http.StatusUnauthorized},
+		{"email taken", `{"email":"taken@example.com","current_password":"password"}`, http.StatusConflict},
+		{"display name too long", `{"display_name":"` + strings.Repeat("x", 51) + `"}`, http.StatusBadRequest},
+		{"bio too long", `{"bio":"` + strings.Repeat("x", 161) + `"}`, http.StatusBadRequest},
+		{"avatar not http", `{"avatar_url":"javascript:alert(1)"}`, http.StatusBadRequest},
+		{"avatar without host", `{"avatar_url":"https://"}`, http.StatusBadRequest},
+		{"profile only", `{"display_name":"Ann","bio":"Hi","avatar_url":"https://example.com/a.png"}`, http.StatusOK},
+		{"password only", `{"password":"secret","current_password":"password"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(update, "PATCH", "/api/users", tt.body, bearer(current.Token))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			got := SelfProfile{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != user.ID || got.Email != "a@example.com" || got.DisplayName != "Ann" {
+				t.Errorf("response = %+v, want user %d Ann with the old email", got, user.ID)
+			}
+		})
+	}
+
+	// The password change signed out every session but the caller's.
+	refresh := http.HandlerFunc(cfg.handlerTokenRefresh)
+	if code := serve(refresh, "POST", "/api/refresh", "", bearer(other.RefreshToken)).Code; code != http.StatusUnauthorized {
+		t.Errorf("other session: refresh status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(refresh, "POST", "/api/refresh", "", bearer(current.RefreshToken)).Code; code != http.StatusOK {
+		t.Errorf("current session: refresh status = %d, want %d", code, http.StatusOK)
+	}
+	if _, err := cfg.DB.AuthorizeUser("a@example.com", "secret"); err != nil {
+		t.Errorf("can't log in with the new password: %v", err)
+	}
+}
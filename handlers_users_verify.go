@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
+	"github.com/takacs/go-web/internal/mail"
+)
+
+// VerifyEmail is the issuer of email verification tokens.
+const VerifyEmail string = "chirpy-verify-email"
+
+const verifyEmailTTL = 24 * time.Hour
+
+// verifyClaims bind a verification token to the address it was sent to, so
+// it stops working if the user changes their email.
+type verifyClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+type verifyResponse struct {
+	ID              int    `json:"id"`
+	Email           string `json:"email"`
+	IsEmailVerified bool   `json:"is_email_verified"`
+}
+
+// sendVerification emails user a link to GET /api/users/verify. The link is
+// built from PUBLIC_URL only: the request's Host header is chosen by the
+// client and would let anyone send a victim's token to their own domain.
+// Without PUBLIC_URL the email carries a relative link.
+func (cfg *apiConfig) sendVerification(user database.User) error {
+	jti, err := auth.RandomString(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	token, err := cfg.keys.Sign(verifyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    VerifyEmail,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(verifyEmailTTL)),
+		},
+		Email: user.Email,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := cfg.baseURL + "/api/users/verify?token=" + url.QueryEscape(token)
+	return cfg.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Follow this link within %d hours to verify your email address:\n\n%s\n\nIf you didn't sign up for Chirpy, ignore this email.",
+			int(verifyEmailTTL.Hours()), link,
+		),
+	})
+}
+
+func (cfg *apiConfig) handlerUsersVerify(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	tokenString := r.URL.Query().Get("token")
+	if tokenString == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing token.")
+		return
+	}
+
+	claims := verifyClaims{}
+	_, err := cfg.keys.Parse(tokenString, &claims, jwt.WithIssuer(VerifyEmail))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired verification link.")
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.ID == "" {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired verification link.")
+		return
+	}
+
+	// Verification links are single use. The link is used up before the
+	// email is verified, so concurrent requests can't both get through.
+	err = cfg.DB.ConsumeToken(claims.ID, claims.ExpiresAt.Time)
+	if errors.Is(err, database.ErrTokenUsed) {
+		respondWithError(w, http.StatusUnauthorized, "Verification link has already been used.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email")
+		return
+	}
+
+	user, err := cfg.DB.VerifyEmail(userID, claims.Email)
+	if errors.Is(err, database.ErrEmailChanged) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, verifyResponse{
+		ID:              user.ID,
+		Email:           user.Email,
+		IsEmailVerified: user.EmailVerified,
+	})
+}
+
+// handlerUsersVerifyResend sends the caller a new verification link.
+func (cfg *apiConfig) handlerUsersVerifyResend(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "No user found.")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email is already verified.")
+		return
+	}
+
+	err = cfg.sendVerification(user)
+	if err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
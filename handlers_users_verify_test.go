@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takacs/go-web/internal/mail"
+)
+
+func TestHandlerUsersVerify(t *testing.T) {
+	cfg := newTestConfig(t)
+	create := http.HandlerFunc(cfg.handlerUsersCreate)
+	verify := http.HandlerFunc(cfg.handlerUsersVerify)
+	resend := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersVerifyResend))
+	update := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersUpdate))
+	verifyCode := func(token string) int {
+		return serve(verify, "GET", "/api/users/verify?token="+url.QueryEscape(token), "", nil).Code
+	}
+
+	if code := serve(create, "POST", "/api/users", `{"email":"not an email","password":"password"}`, nil).Code; code != http.StatusBadRequest {
+		t.Errorf("invalid email: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	w := serve(create, "POST", "/api/users", `{"email":"a@example.com","password":"password"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	user := User{}
+	err := json.NewDecoder(w.Body).Decode(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsEmailVerified {
+		t.Error("new user is verified before following the link")
+	}
+	msg := nextMail(t, cfg)
+	if msg.To != "a@example.com" || !strings.Contains(msg.Body, "\n/api/users/verify?token=") {
+		t.Fatalf("verification mail to %q: %q", msg.To, msg.Body)
+	}
+	token := mailToken(t, msg)
+
+	if code := verifyCode("garbage"); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := verifyCode(accessToken(t, cfg, user.ID)); code != http.StatusUnauthorized {
+		t.Errorf("access token as a verification link: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := verifyCode(token); code != http.StatusOK {
+		t.Fatalf("verify: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := verifyCode(token); code != http.StatusUnauthorized {
+		t.Errorf("reused link: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	access := accessToken(t, cfg, user.ID)
+	if code := serve(resend, "POST", "/api/users/verify/resend", "", bearer(access)).Code; code != http.StatusConflict {
+		t.Errorf("resend when verified: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	// Changing the address sends a new link; a link for the old address
+	// no longer verifies it.
+	code := serve(update, "PUT", "/api/users", `{"email":"b@example.com","current_password":"password"}`, bearer(access)).Code
+	if code != http.StatusOK {
+		t.Fatalf("update: status = %d, want %d", code, http.StatusOK)
+	}
+	changed := mailToken(t, nextMail(t, cfg))
+	if code := serve(resend, "POST", "/api/users/verify/resend", "", bearer(access)).Code; code != http.StatusAccepted {
+		t.Fatalf("resend: status = %d, want %d", code, http.StatusAccepted)
+	}
+	resent := nextMail(t, cfg)
+	if resent.To != "b@example.com" {
+		t.Errorf("resent mail to %q, want b@example.com", resent.To)
+	}
+	code = serve(update, "PUT", "/api/users", `{"email":"c@example.com","current_password":"password"}`, bearer(access)).Code
+	if code != http.StatusOK {
+		t.Fatalf("second update: status = %d, want %d", code, http.StatusOK)
+	}
+	nextMail(t, cfg)
+	if code := verifyCode(changed); code != http.StatusConflict {
+		t.Errorf("link for a replaced address: status = %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestVerificationMailInBackground(t *testing.T) {
+	cfg := newTestConfig(t)
+	// An unbuffered channel blocks Send until the test reads the message,
+	// like a mail server that hangs.
+	cfg.mailer = &testMailer{sent: make(chan mail.Message)}
+	create := http.HandlerFunc(cfg.handlerUsersCreate)
+	update := cfg.middlewareAuth(http.HandlerFunc(cfg.handlerUsersUpdate))
+	respond := func(name string, serveRequest func() int, want int) {
+		t.Helper()
+		done := make(chan int, 1)
+		go func() {
+			done <- serveRequest()
+		}()
+		select {
+		case code := <-done:
+			if code != want {
+				t.Errorf("%s: status = %d, want %d", name, code, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s waited for the mail to be sent", name)
+		}
+		nextMail(t, cfg)
+	}
+
+	respond("create", func() int {
+		return serve(create, "POST", "/api/users", `{"email":"a@example.com","password":"password"}`, nil).Code
+	}, http.StatusCreated)
+	access := accessToken(t, cfg, 1)
+	respond("update", func() int {
+		return serve(update, "PUT", "/api/users", `{"email":"b@example.com","current_password":"password"}`, bearer(access)).Code
+	}, http.StatusOK)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/takacs/go-web/internal/auth"
+)
+
+type jwksResponse struct {
+	Keys []auth.JWK `json:"keys"`
+}
+
+type discoveryResponse struct {
+	Issuer                  string   `json:"issuer"`
+	JWKSURI                 string   `json:"jwks_uri"`
+	TokenEndpoint           string   `json:"token_endpoint"`
+	RefreshEndpoint         string   `json:"refresh_endpoint"`
+	RevocationEndpoint      string   `json:"revocation_endpoint"`
+	SigningAlgsSupported    []string `json:"token_signing_alg_values_supported"`
+	SubjectTypesSupported   []string `json:"subject_types_supported"`
+	ResponseTypesSupported  []string `json:"response_types_supported"`
+	GrantTypesSupported     []string `json:"grant_types_supported"`
+	ClaimsSupported         []string `json:"claims_supported"`
+	TokenEndpointAuthMethod []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// handlerJWKS publishes the public keys that verify Chirpy tokens. Only
+// asymmetric keys are listed; HS256 secrets are never exposed.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, jwksResponse{Keys: cfg.keys.JWKS()})
+}
+
+// handlerDiscovery describes the token endpoints. The issuer is the iss
+// claim of access tokens, so verifiers can check tokens against it. Without
+// PUBLIC_URL the URLs come from the request's Host header, which clients
+// control, so the response must not be stored by shared caches.
+func (cfg *apiConfig) handlerDiscovery(w http.ResponseWriter, r *http.Request) {
+	logCall(r)
+	base := cfg.publicURL(r)
+	if cfg.baseURL != "" {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	respondWithJSON(w, http.StatusOK, discoveryResponse{
+		Issuer:                  Access,
+		JWKSURI:                 base + "/.well-known/jwks.json",
+		TokenEndpoint:           base + "/api/login",
+		RefreshEndpoint:         base + "/api/refresh",
+		RevocationEndpoint:      base + "/api/revoke",
+		SigningAlgsSupported:    cfg.keys.Algorithms(),
+		SubjectTypesSupported:   []string{"public"},
+		ResponseTypesSupported:  []string{"token"},
+		GrantTypesSupported:     []string{"password", "refresh_token"},
+		ClaimsSupported:         []string{"iss", "sub", "iat", "exp", "jti", "sid", "role"},
+		TokenEndpointAuthMethod: []string{"none"},
+	})
+}
+
+// publicURL is the externally visible base URL of the server: PUBLIC_URL if
+// set, otherwise derived from the request. The derived URL is attacker
+// controlled; never cache it or send it to anyone but the requester.
+func (cfg *apiConfig) publicURL(r *http.Request) string {
+	if cfg.baseURL != "" {
+		return cfg.baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
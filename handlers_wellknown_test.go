@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHandlerJWKS(t *testing.T) {
+	cfg := newTestConfig(t)
+	w := serve(http.HandlerFunc(cfg.handlerJWKS), "GET", "/.well-known/jwks.json", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	got := jwksResponse{}
+	err := json.NewDecoder(w.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test keyring only holds an HS256 secret, which must never be
+	// published.
+	if len(got.Keys) != 0 {
+		t.Errorf("keys = %+v, want none", got.Keys)
+	}
+}
+
+func TestHandlerDiscovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		header  http.Header
+		want    string
+		// Host-derived URLs must not be cached.
+		wantCache string
+	}{
+		{"request host", "", nil, "http://example.com", "no-store"},
+		{"forwarded https", "", http.Header{"X-Forwarded-Proto": {"https"}}, "https://example.com", "no-store"},
+		{"configured", "https://chirpy.example", nil, "https://chirpy.example", "public, max-age=300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.baseURL = tt.baseURL
+			w := serve(http.HandlerFunc(cfg.handlerDiscovery), "GET", "http://example.com/.well-known/openid-configuration", "", tt.header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if cache := w.Header().Get("Cache-Control"); cache != tt.wantCache {
+				t.Errorf("Cache-Control = %q, want %q", cache, tt.wantCache)
+			}
+			got := discoveryResponse{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.JWKSURI != tt.want+"/.well-known/jwks.json" || got.TokenEndpoint != tt.want+"/api/login" {
+				t.Errorf("jwks_uri %q, token_endpoint %q; want base %q", got.JWKSURI, got.TokenEndpoint, tt.want)
+			}
+			// Verifiers compare the iss claim with the advertised issuer.
+			user, err := cfg.DB.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cfg.parseToken(accessToken(t, cfg, user.ID), got.Issuer)
+			if err != nil {
+				t.Errorf("access token doesn't match issuer %q: %v", got.Issuer, err)
+			}
+			if len(got.SigningAlgsSupported) != 1 || got.SigningAlgsSupported[0] != "HS256" {
+				t.Errorf("signing algorithms = %v, want [HS256]", got.SigningAlgsSupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a JWT signing or verification key identified by its kid.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// private is nil for keys that can only verify.
+	private any
+	public  any
+}
+
+// CanSign reports whether the key holds secret or private key material.
+func (k *Key) CanSign() bool {
+	return k.private != nil
+}
+
+// PublicKey returns the public half of an asymmetric key, or nil for HMAC
+// secrets.
+func (k *Key) PublicKey() crypto.PublicKey {
+	if _, ok := k.Method.(*jwt.SigningMethodHMAC); ok {
+		return nil
+	}
+	return k.public
+}
+
+// NewHMACKey returns an HS256 key for a shared secret.
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty HMAC secret")
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+}
+
+// LoadPEMKey reads an Ed25519 or RSA key from a PEM file. Private keys can
+// sign and verify; public keys can only verify. If id is empty the key ID is
+// derived from the public key.
+func LoadPEMKey(path, id string) (*Key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	key := &Key{ID: id}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.private = parsed
+	case "RSA PRIVATE KEY":
+		parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.private = parsed
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.public = parsed
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+
+	switch private := key.private.(type) {
+	case ed25519.PrivateKey:
+		key.public = private.Public()
+	case *rsa.PrivateKey:
+		key.public = private.Public()
+	case nil:
+	default:
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, private)
+	}
+
+	switch key.public.(type) {
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("%s: unsupported public key type %T", path, key.public)
+	}
+
+	if key.ID == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.public)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		key.ID = base64.RawURLEncoding.EncodeToString(sum[:12])
+	}
+	return key, nil
+}
+
+// Keyring signs tokens with its active key and verifies tokens against any
+// of its keys, selected by the kid header. Only the algorithms of the
+// configured keys are accepted, and a token's algorithm must match its key.
+type Keyring struct {
+	active *Key
+	list   []*Key
+	keys   map[string]*Key
+	// legacy verifies tokens that were issued without a kid header.
+	legacy *Key
+	// allowed, when set, narrows the accepted algorithms.
+	allowed map[string]bool
+}
+
+// NewKeyring builds a keyring that signs with active and additionally
+// accepts tokens signed by any of the previous keys.
+func NewKeyring(active *Key, previous ...*Key) (*Keyring, error) {
+	if active == nil || !active.CanSign() {
+		return nil, errors.New("active key must be able to sign")
+	}
+
+	k := &Keyring{active: active, keys: map[string]*Key{}}
+	for _, key := range append([]*Key{active}, previous...) {
+		if _, exists := k.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		k.keys[key.ID] = key
+		k.list = append(k.list, key)
+	}
+	return k, nil
+}
+
+// SetLegacyKey selects the key used for tokens without a kid header, such
+// as those issued before key IDs were introduced.
+func (k *Keyring) SetLegacyKey(id string) error {
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("unknown key ID %q", id)
+	}
+	k.legacy = key
+	return nil
+}
+
+// AllowAlgorithms restricts the accepted signing algorithms to algs. Keys
+// using any other algorithm can no longer verify tokens.
+func (k *Keyring) AllowAlgorithms(algs ...string) error {
+	allowed := map[string]bool{}
+	for _, alg := range algs {
+		allowed[alg] = true
+	}
+	if !allowed[k.active.Method.Alg()] {
+		return fmt.Errorf("active key algorithm %s is not allowed", k.active.Method.Alg())
+	}
+	k.allowed = allowed
+	return nil
+}
+
+// Keys returns every key in the keyring, the active key first.
+func (k *Keyring) Keys() []*Key {
+	return append([]*Key{}, k.list...)
+}
+
+// Algorithms returns the signing algorithms the keyring accepts.
+func (k *Keyring) Algorithms() []string {
+	seen := map[string]bool{}
+	algs := []string{}
+	for _, key := range k.list {
+		alg := key.Method.Alg()
+		if k.allowed != nil && !k.allowed[alg] {
+			continue
+		}
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// Sign signs claims with the active key and sets the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.private)
+}
+
+// Parse verifies tokenString and decodes it into claims.
+func (k *Keyring) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts, jwt.WithValidMethods(k.Algorithms()))
+	return jwt.ParseWithClaims(tokenString, claims, k.keyfunc, opts...)
+}
+
+func (k *Keyring) keyfunc(token *jwt.Token) (interface{}, error) {
+	key := k.legacy
+	if kid, ok := token.Header["kid"]; ok {
+		id, isString := kid.(string)
+		if !isString {
+			return nil, errors.New("invalid kid header")
+		}
+		key = k.keys[id]
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("algorithm %s doesn't match key %s", token.Method.Alg(), key.ID)
+	}
+	return key.public, nil
+}
+
+// JWK is the public JSON Web Key form of a Key (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// OKP (Ed25519) members.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	// RSA members.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// JWK returns the public JWK for an asymmetric key. HMAC secrets have no
+// public form and return false.
+func (k *Key) JWK() (JWK, bool) {
+	jwk := JWK{KeyID: k.ID, Algorithm: k.Method.Alg(), Use: "sig"}
+	switch public := k.PublicKey().(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// JWKS returns the public keys that verify tokens from this keyring, for
+// publishing at a jwks_uri. Keys whose algorithm isn't accepted are left out.
+func (k *Keyring) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, key := range k.list {
+		if k.allowed != nil && !k.allowed[key.Method.Alg()] {
+			continue
+		}
+		if jwk, ok := key.JWK(); ok {
+			jwks = append(jwks, jwk)
+		}
+	}
+	return jwks
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newEd25519Key(t *testing.T, id string) *Key {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadPEMKey(path, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newHMACKey(t *testing.T, id string) *Key {
+	t.Helper()
+	key, err := NewHMACKey(id, []byte("secret-"+id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signWith signs a token with an arbitrary method and secret, setting kid
+// unless it is empty, to forge tokens the keyring must refuse.
+func signWith(t *testing.T, method jwt.SigningMethod, kid any, secret any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	if kid != nil {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestKeyringParse(t *testing.T) {
+	ed := newEd25519Key(t, "ed")
+	old := newHMACKey(t, "old")
+	other := newHMACKey(t, "other")
+
+	ring, err := NewKeyring(ed, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic := []byte(ed.PublicKey().(ed25519.PublicKey))
+
+	tests := []struct {
+		name   string
+		token  string
+		legacy string
+		allow  []string
+		ok     bool
+	}{
+		{
+			name:  "active key",
+			token: signWith(t, jwt.SigningMethodEdDSA, "ed", ed.private),
+			ok:    true,
+		},
+		{
+			name:  "previous key",
+			token: signWith(t, jwt.SigningMethodHS256, "old", old.private),
+			ok:    true,
+		},
+		{
+			name:  "previous key algorithm not allowed",
+			token: signWith(t, jwt.SigningMethodHS256, "old", old.private),
+			allow: []string{"EdDSA"},
+		},
+		{
+			name:  "HMAC signed with the public key",
+			token: signWith(t, jwt.SigningMethodHS256, "ed", edPublic),
+		},
+		{
+			name:  "algorithm doesn't match key",
+			token: signWith(t, jwt.SigningMethodHS384, "old", old.private),
+		},
+		{
+			name:  "none algorithm",
+			token: signWith(t, jwt.SigningMethodNone, "old", jwt.UnsafeAllowNoneSignatureType),
+		},
+		{
+			name:  "unknown kid",
+			token: signWith(t, jwt.SigningMethodHS256, "other", other.private),
+		},
+		{
+			name:  "kid is not a string",
+			token: signWith(t, jwt.SigningMethodHS256, 1, old.private),
+		},
+		{
+			name:  "wrong secret",
+			token: signWith(t, jwt.SigningMethodHS256, "old", other.private),
+		},
+		{
+			name:  "no kid without legacy key",
+			token: signWith(t, jwt.SigningMethodHS256, nil, old.private),
+		},
+		{
+			name:   "no kid with legacy key",
+			token:  signWith(t, jwt.SigningMethodHS256, nil, old.private),
+			legacy: "old",
+			ok:     true,
+		},
+		{
+			name:   "no kid signed by another key",
+			token:  signWith(t, jwt.SigningMethodHS256, nil, other.private),
+			legacy: "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring.legacy = nil
+			ring.allowed = nil
+			if tt.legacy != "" {
+				if err := ring.SetLegacyKey(tt.legacy); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.allow != nil {
+				if err := ring.AllowAlgorithms(tt.allow...); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := ring.Parse(tt.token, &jwt.RegisteredClaims{})
+			if tt.ok && err != nil {
+				t.Errorf("Parse() error = %v, want nil", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("Parse() accepted the token")
+			}
+		})
+	}
+}
+
+func TestKeyringSign(t *testing.T) {
+	old := newHMACKey(t, "old")
+	ed := newEd25519Key(t, "")
+
+	ring, err := NewKeyring(ed, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ring.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ring.Parse(signed, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != ed.ID || token.Method.Alg() != "EdDSA" {
+		t.Errorf("signed with kid %v alg %s, want %s EdDSA", token.Header["kid"], token.Method.Alg(), ed.ID)
+	}
+	if ed.ID == "" {
+		t.Error("no key ID derived from the public key")
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	a := newHMACKey(t, "a")
+	verifyOnly := &Key{ID: "v", Method: jwt.SigningMethodEdDSA, public: newEd25519Key(t, "v").public}
+
+	tests := []struct {
+		name     string
+		active   *Key
+		previous []*Key
+		ok       bool
+	}{
+		{"single key", a, nil, true},
+		{"verify-only previous key", a, []*Key{verifyOnly}, true},
+		{"no active key", nil, nil, false},
+		{"active key can't sign", verifyOnly, nil, false},
+		{"duplicate key ID", a, []*Key{newHMACKey(t, "a")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyring(tt.active, tt.previous...)
+			if (err == nil) != tt.ok {
+				t.Errorf("NewKeyring() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKeyringAllowAlgorithms(t *testing.T) {
+	ed := newEd25519Key(t, "ed")
+	old := newHMACKey(t, "old")
+	ring, err := NewKeyring(ed, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ring.AllowAlgorithms("HS256")
+	if err == nil {
+		t.Error("AllowAlgorithms() accepted a list without the active key's algorithm")
+	}
+	err = ring.AllowAlgorithms("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algs := ring.Algorithms(); len(algs) != 1 || algs[0] != "EdDSA" {
+		t.Errorf("Algorithms() = %v, want [EdDSA]", algs)
+	}
+	if jwks := ring.JWKS(); len(jwks) != 1 || jwks[0].KeyID != "ed" {
+		t.Errorf("JWKS() = %v, want only key ed", jwks)
+	}
+}
+
+func TestKeyringJWKS(t *testing.T) {
+	ed := newEd25519Key(t, "ed")
+	hmac := newHMACKey(t, "hmac")
+	ring, err := NewKeyring(hmac, ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := ring.JWKS()
+	if len(jwks) != 1 {
+		t.Fatalf("JWKS() = %v, want only the Ed25519 key", jwks)
+	}
+	want := JWK{
+		KeyType:   "OKP",
+		KeyID:     "ed",
+		Algorithm: "EdDSA",
+		Use:       "sig",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(ed.PublicKey().(ed25519.PublicKey)),
+	}
+	if jwks[0] != want {
+		t.Errorf("JWKS()[0] = %+v, want %+v", jwks[0], want)
+	}
+}
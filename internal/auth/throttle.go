@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottlePolicy configures a Throttle.
+type ThrottlePolicy struct {
+	// FreeAttempts failures are allowed before any delay is imposed.
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts; it
+	// doubles with every further failure.
+	BaseDelay time.Duration
+	// LockoutAttempts failures lock the key out for LockoutDuration.
+	LockoutAttempts int
+	LockoutDuration time.Duration
+}
+
+// Throttle tracks failed attempts per key, such as an email address or a
+// client IP, and tells callers how long a key must wait before trying
+// again. Failures are forgotten once LockoutDuration passes without a new
+// one.
+type Throttle struct {
+	policy ThrottlePolicy
+
+	mu        sync.Mutex
+	attempts  map[string]*attempts
+	lastSweep time.Time
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	blockedTill time.Time
+}
+
+func NewThrottle(policy ThrottlePolicy) *Throttle {
+	return &Throttle{
+		policy:   policy,
+		attempts: map[string]*attempts{},
+	}
+}
+
+// Acquire reserves an attempt for key. If key must still wait, nothing is
+// reserved and the wait is returned. Otherwise the attempt is counted as a
+// failure up front, so that concurrent attempts can't all slip past the
+// limit, and lockedOut reports whether this attempt used up the last one.
+// Call Reset or Release when the attempt succeeds.
+func (t *Throttle) Acquire(key string) (wait time.Duration, lockedOut bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+	a, ok := t.attempts[key]
+	if !ok || t.expired(a, now) {
+		a = &attempts{}
+		t.attempts[key] = a
+	}
+	if wait := a.blockedTill.Sub(now); wait > 0 {
+		return wait, false
+	}
+	a.failures++
+	a.lastFailure = now
+
+	switch {
+	case a.failures >= t.policy.LockoutAttempts:
+		a.blockedTill = now.Add(t.policy.LockoutDuration)
+		return 0, true
+	case a.failures > t.policy.FreeAttempts:
+		delay := t.policy.BaseDelay << (a.failures - t.policy.FreeAttempts - 1)
+		if delay <= 0 || delay > t.policy.LockoutDuration {
+			delay = t.policy.LockoutDuration
+		}
+		a.blockedTill = now.Add(delay)
+	}
+	return 0, false
+}
+
+// Reset forgets the failures of key, after a successful attempt.
+func (t *Throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, key)
+}
+
+// Release gives back an attempt reserved by Acquire that succeeded or was
+// never made, without forgetting earlier failures. A delay the attempt
+// caused stays in place.
+func (t *Throttle) Release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.attempts[key]
+	if ok && a.failures > 0 {
+		a.failures--
+	}
+}
+
+// sweep drops keys whose failures have been forgotten, at most once a
+// minute, so the map doesn't grow with every address ever seen.
+func (t *Throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for key, a := range t.attempts {
+		if t.expired(a, now) {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+func (t *Throttle) expired(a *attempts, now time.Time) bool {
+	return now.After(a.blockedTill) && now.Sub(a.lastFailure) > t.policy.LockoutDuration
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleAcquire(t *testing.T) {
+	policy := ThrottlePolicy{
+		FreeAttempts:    2,
+		BaseDelay:       time.Hour,
+		LockoutAttempts: 5,
+		LockoutDuration: 24 * time.Hour,
+	}
+
+	// Each step is one call; "acquire" checks its result, the others
+	// change the key's state.
+	type step struct {
+		op        string
+		wait      bool
+		lockedOut bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "free attempts",
+			steps: []step{
+				{op: "acquire"},
+				{op: "acquire"},
+			},
+		},
+		{
+			name: "delay after free attempts",
+			steps: []step{
+				{op: "acquire"},
+				{op: "acquire"},
+				{op: "acquire"},
+				{op: "acquire", wait: true},
+			},
+		},
+		{
+			name: "reset forgets failures",
+			steps: []step{
+				{op: "acquire"},
+				{op: "acquire"},
+				{op: "reset"},
+				{op: "acquire"},
+				{op: "acquire"},
+			},
+		},
+		{
+			name: "release returns the attempt",
+			steps: []step{
+				{op: "acquire"},
+				{op: "release"},
+				{op: "acquire"},
+				{op: "release"},
+				{op: "acquire"},
+				{op: "acquire"},
+			},
+		},
+		{
+			name: "release keeps the delay",
+			steps: []step{
+				{op: "acquire"},
+				{op: "acquire"},
+				{op: "acquire"},
+				{op: "release"},
+				{op: "acquire", wait: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := NewThrottle(policy)
+			for i, s := range tt.steps {
+				switch s.op {
+				case "reset":
+					throttle.Reset("key")
+				case "release":
+					throttle.Release("key")
+				case "acquire":
+					wait, lockedOut := throttle.Acquire("key")
+					if (wait > 0) != s.wait || lockedOut != s.lockedOut {
+						t.Fatalf("step %d: Acquire() = %v, %v; want wait %v, locked out %v",
+							i, wait, lockedOut, s.wait, s.lockedOut)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleLockout(t *testing.T) {
+	throttle := NewThrottle(ThrottlePolicy{
+		FreeAttempts:    3,
+		LockoutAttempts: 3,
+		LockoutDuration: 50 * time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if wait, lockedOut := throttle.Acquire("key"); wait != 0 || lockedOut {
+			t.Fatalf("attempt %d throttled: %v, %v", i+1, wait, lockedOut)
+		}
+	}
+	if _, lockedOut := throttle.Acquire("key"); !lockedOut {
+		t.Fatal("last attempt didn't lock the key out")
+	}
+	if wait, _ := throttle.Acquire("key"); wait <= 0 {
+		t.Fatal("locked out key wasn't asked to wait")
+	}
+	if wait, _ := throttle.Acquire("other"); wait != 0 {
+		t.Fatal("lockout affected another key")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if wait, lockedOut := throttle.Acquire("key"); wait != 0 || lockedOut {
+		t.Fatalf("failures weren't forgotten after the lockout: %v, %v", wait, lockedOut)
+	}
+}
+
+func TestThrottleConcurrentAcquire(t *testing.T) {
+	throttle := NewThrottle(ThrottlePolicy{
+		FreeAttempts:    4,
+		BaseDelay:       time.Hour,
+		LockoutAttempts: 10,
+		LockoutDuration: time.Hour,
+	})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if wait, _ := throttle.Acquire("key"); wait == 0 {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts plus the one that starts the delay.
+	if admitted != 5 {
+		t.Errorf("%d concurrent attempts admitted, want 5", admitted)
+	}
+}
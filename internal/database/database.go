@@ -1,68 +1,266 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// DB is the JSON file store. The whole dataset is kept in memory; changes
+// are journaled to <path>.journal and periodically compacted into path.
 type DB struct {
 	path string
+	opts Options
 	mu   *sync.RWMutex
+	data DBStructure
+
+	flushMu        sync.Mutex
+	pending        []journalEntry
+	journal        *os.File
+	journalEntries int
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
+// Journal table names for the collections in DBStructure.
+const (
+	tableChirps         = "chirps"
+	tableUsers          = "users"
+	tableRefreshTokens  = "refresh_tokens"
+	tableWebhooks       = "webhook_events"
+	tableSequences      = "sequences"
+	tableRevisions      = "chirp_revisions"
+	tableSessions       = "sessions"
+	tableDeniedTokens   = "denied_tokens"
+	tablePasswordResets = "password_resets"
+	tableModerationLog  = "moderation_log"
+	tableReports        = "reports"
+)
+
 type DBStructure struct {
-	Chirps      map[int]Chirp         `json:"chirps"`
-	Users       map[int]User          `json:"user"`
-	Revocations map[string]Revocation `json:"refresh_tokens"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"user"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	Webhooks      map[string]time.Time    `json:"webhook_events"`
+	// Sequences holds the last ID handed out per table so IDs of deleted
+	// rows are never reused.
+	Sequences      map[string]int        `json:"sequences"`
+	ChirpRevisions map[int]ChirpRevision `json:"chirp_revisions"`
+	Sessions       map[string]Session    `json:"sessions"`
+	// DeniedTokens maps the jti of revoked access tokens to their expiry.
+	DeniedTokens   map[string]time.Time     `json:"denied_tokens"`
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
+	ModerationLog  map[int]ModerationEntry  `json:"moderation_log"`
+	Reports        map[int]Report           `json:"reports"`
+
+	changes   []change
+	changeErr error
 }
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set when the author deletes the chirp. Deleted chirps
+	// can be restored until they are purged.
+	DeletedAt time.Time `json:"deleted_at"`
+	// HiddenAt is set when a moderator hides the chirp. Hidden chirps are
+	// only visible to moderators.
+	HiddenAt     time.Time `json:"hidden_at"`
+	HiddenReason string    `json:"hidden_reason"`
+}
+
+func (c Chirp) IsDeleted() bool {
+	return !c.DeletedAt.IsZero()
+}
+
+func (c Chirp) IsHidden() bool {
+	return !c.HiddenAt.IsZero()
+}
+
+// IsVisible reports whether the chirp can be shown to everyone.
+func (c Chirp) IsVisible() bool {
+	return !c.IsDeleted() && !c.IsHidden()
+}
+
+func (c Chirp) hasStatus(status ChirpStatus) bool {
+	switch status {
+	case ChirpsHidden:
+		return c.IsHidden()
+	case ChirpsDeleted:
+		return c.IsDeleted()
+	case ChirpsAll:
+		return true
+	}
+	return c.IsVisible()
+}
+
+// ChirpRevision is one version of a chirp's body. A revision is stored when
+// a chirp is created and every time it is edited.
+type ChirpRevision struct {
+	ID        int       `json:"id"`
+	ChirpID   int       `json:"chirp_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type User struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	// EmailVerified is set once the user follows the verification link
+	// sent to Email, and cleared when Email changes.
+	EmailVerified bool `json:"email_verified"`
+	// DisplayName, Bio and AvatarURL make up the public profile.
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Role        Role      `json:"role"`
+	// SuspendedAt is set while a moderator has suspended the user, who
+	// can't log in or refresh tokens meanwhile.
+	SuspendedAt     time.Time `json:"suspended_at"`
+	SuspendedReason string    `json:"suspended_reason"`
+}
+
+func (u User) IsSuspended() bool {
+	return !u.SuspendedAt.IsZero()
+}
+
+// Report is a user's complaint about a chirp. It stays open until a
+// moderator resolves it.
+type Report struct {
+	ID         int          `json:"id"`
+	ChirpID    int          `json:"chirp_id"`
+	ReporterID int          `json:"reporter_id"`
+	Reason     ReportReason `json:"reason"`
+	Details    string       `json:"details"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ResolvedAt time.Time    `json:"resolved_at"`
+	ResolverID int          `json:"resolver_id"`
+	Resolution Resolution   `json:"resolution"`
+	Note       string       `json:"note"`
+}
+
+func (r Report) IsResolved() bool {
+	return !r.ResolvedAt.IsZero()
 }
 
-type Revocation struct {
-	Token     string    `json:"token"`
+// ModerationEntry records one action of a moderator. Entries are only ever
+// added, never changed or removed.
+type ModerationEntry struct {
+	ID int `json:"id"`
+	// ModeratorID is zero for actions taken automatically, such as hiding
+	// a chirp with too many reports.
+	ModeratorID int              `json:"moderator_id"`
+	Action      ModerationAction `json:"action"`
+	// ChirpID is the chirp acted on, zero for actions on users.
+	ChirpID int `json:"chirp_id"`
+	// UserID is the user acted on, or the author of the chirp.
+	UserID    int       `json:"user_id"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RefreshToken is a stored refresh token, keyed by the SHA-256 of the token;
+// the token itself is never stored. Each refresh replaces the token
+// with a new one in the same family; presenting a token that was already
+// replaced revokes the whole family.
+type RefreshToken struct {
+	Hash     string `json:"hash"`
+	UserID   int    `json:"user_id"`
+	FamilyID string `json:"family_id"`
+	// DeviceID, when set, must be presented again to refresh the token.
+	DeviceID  string    `json:"device_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RotatedAt time.Time `json:"rotated_at"`
 	RevokedAt time.Time `json:"revoked_at"`
 }
 
-func NewDB(path string) (*DB, error) {
+// Session is one login of a user. Its ID is the family ID of the refresh
+// tokens issued for the login, and revoking it revokes them all.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// IsActive reports whether the session can still be refreshed at now.
+func (s Session) IsActive(now time.Time) bool {
+	return s.RevokedAt.IsZero() && now.Before(s.ExpiresAt)
+}
+
+// PasswordReset is a single-use password reset token, keyed by its SHA-256
+// like RefreshToken.
+type PasswordReset struct {
+	Hash      string    `json:"hash"`
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"`
+}
+
+func NewDB(path string, opts Options) (*DB, error) {
+	if opts.FlushInterval < 0 {
+		return nil, errors.New("flush interval can't be negative")
+	}
+	if opts.CompactAfter <= 0 {
+		opts.CompactAfter = defaultCompactAfter
+	}
 	db := &DB{
 		path: path,
+		opts: opts,
 		mu:   &sync.RWMutex{},
+		done: make(chan struct{}),
 	}
-	err := db.ensureDB()
-	return db, err
-}
-
-func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+	err := db.open()
 	if err != nil {
-		return Chirp{}, err
+		return nil, err
 	}
 
-	id := len(dbStructure.Chirps) + 1
-	chirp := Chirp{
-		ID:       id,
-		Body:     body,
-		AuthorID: author_id,
+	if opts.FlushInterval > 0 {
+		db.wg.Add(1)
+		go db.flushLoop()
 	}
-	dbStructure.Chirps[id] = chirp
+	return db, nil
+}
 
-	err = db.writeDB(dbStructure)
+func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		if _, exists := dbStructure.Users[author_id]; !exists {
+			return errors.New("User not found")
+		}
+		now := time.Now().UTC()
+		id := dbStructure.nextID(tableChirps)
+		chirp = Chirp{
+			ID:        id,
+			Body:      body,
+			AuthorID:  author_id,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		put(dbStructure, tableChirps, dbStructure.Chirps, id, chirp)
+		dbStructure.addRevision(id, body, now)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -71,30 +269,29 @@ func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
 }
 
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	if dbStructure.userExists(email) {
-		return User{}, errors.New("User with that email already exists.")
-	}
-
 	hashed_password, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return User{}, err
 	}
 
-	id := len(dbStructure.Users) + 1
-	user := User{
-		ID:       id,
-		Email:    email,
-		Password: string(hashed_password),
-		IsChirpyRed: false,
-	}
-	dbStructure.Users[id] = user
+	user := User{}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		if dbStructure.userExists(email) {
+			return ErrEmailTaken
+		}
 
-	err = db.writeDB(dbStructure)
+		id := dbStructure.nextID(tableUsers)
+		user = User{
+			ID:          id,
+			Email:       email,
+			Password:    string(hashed_password),
+			IsChirpyRed: false,
+			CreatedAt:   time.Now().UTC(),
+			Role:        RoleUser,
+		}
+		put(dbStructure, tableUsers, dbStructure.Users, id, user)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -102,6 +299,32 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	return user, nil
 }
 
+// nextID allocates the next ID for table.
+func (db *DBStructure) nextID(table string) int {
+	id := db.Sequences[table] + 1
+	put(db, tableSequences, db.Sequences, table, id)
+	return id
+}
+
+// seedSequences makes sure no sequence is behind the IDs already in use,
+// which is the case for files written before sequences were persisted.
+// Every table whose IDs come from nextID is listed here.
+func (db *DBStructure) seedSequences() {
+	seedSequence(db, tableChirps, db.Chirps)
+	seedSequence(db, tableUsers, db.Users)
+	seedSequence(db, tableRevisions, db.ChirpRevisions)
+	seedSequence(db, tableModerationLog, db.ModerationLog)
+	seedSequence(db, tableReports, db.Reports)
+}
+
+func seedSequence[V any](db *DBStructure, table string, m map[int]V) {
+	for id := range m {
+		if id > db.Sequences[table] {
+			db.Sequences[table] = id
+		}
+	}
+}
+
 func (db *DBStructure) userExists(email string) bool {
 	for _, user := range db.Users {
 		if user.Email == email {
@@ -112,198 +335,1102 @@ func (db *DBStructure) userExists(email string) bool {
 }
 
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+	chirps := []Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirps = make([]Chirp, 0, len(dbStructure.Chirps))
+		for _, chirp := range dbStructure.Chirps {
+			if !chirp.IsVisible() {
+				continue
+			}
+			chirps = append(chirps, chirp)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
-	}
-
 	return chirps, nil
 }
 
-func (db *DB) GetChirpById(id int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+// QueryChirps returns the chirps matching query ordered by ID, plus the
+// cursor for the next page, which is 0 when there are no more chirps.
+func (db *DB) QueryChirps(query ChirpQuery) ([]Chirp, int, error) {
+	chirps := []Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		contains := strings.ToLower(query.Contains)
+		for _, chirp := range dbStructure.Chirps {
+			if !chirp.hasStatus(query.Status) {
+				continue
+			}
+			if query.AuthorID != 0 && chirp.AuthorID != query.AuthorID {
+				continue
+			}
+			if contains != "" && !strings.Contains(strings.ToLower(chirp.Body), contains) {
+				continue
+			}
+			if query.After != 0 {
+				if !query.Descending && chirp.ID <= query.After {
+					continue
+				}
+				if query.Descending && chirp.ID >= query.After {
+					continue
+				}
+			}
+			chirps = append(chirps, chirp)
+		}
+		return nil
+	})
 	if err != nil {
-		return Chirp{}, err
+		return nil, 0, err
 	}
 
-	val, ok := dbStructure.Chirps[id]
-	if !ok {
-		return Chirp{}, errors.New("No Chirp")
+	sort.Slice(chirps, func(i, j int) bool {
+		if query.Descending {
+			return chirps[i].ID > chirps[j].ID
+		}
+		return chirps[i].ID < chirps[j].ID
+	})
+
+	next := 0
+	if query.Limit > 0 && len(chirps) > query.Limit {
+		chirps = chirps[:query.Limit]
+		next = chirps[len(chirps)-1].ID
 	}
-	return val, nil
+	return chirps, next, nil
+}
+
+func (db *DB) GetChirpById(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		val, ok := dbStructure.Chirps[id]
+		if !ok {
+			return errors.New("No Chirp")
+		}
+		chirp = val
+		return nil
+	})
+	return chirp, err
 }
 
-func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps:      map[int]Chirp{},
-		Users:       map[int]User{},
-		Revocations: map[string]Revocation{},
+func (db *DB) GetUser(id int) (User, error) {
+	user := User{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var exists bool
+		user, exists = dbStructure.Users[id]
+		if !exists {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
-	return db.writeDB(dbStructure)
+	return user, nil
 }
 
-func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return db.createDB()
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	user := User{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, u := range dbStructure.Users {
+			if u.Email == email {
+				user = u
+				return nil
+			}
+		}
+		return errors.New("User not found")
+	})
+	if err != nil {
+		return User{}, err
 	}
-	return err
+	return user, nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+func (db *DB) AuthorizeUser(email, password string) (User, error) {
+	user := User{}
+	found := false
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, u := range dbStructure.Users {
+			if u.Email == email {
+				user = u
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	err = checkPassword(user, found, password)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
 
-	dbStructure := DBStructure{}
-	dat, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return dbStructure, err
+// UpdateUser applies the fields set in update. Changing the email or the
+// password needs the current password, and revokes every other session of
+// the user; profile fields can be changed freely.
+func (db *DB) UpdateUser(id int, update UserUpdate) (User, error) {
+	hashed_password := ""
+	if update.Password != nil {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+		hashed_password = string(hashed)
 	}
-	err = json.Unmarshal(dat, &dbStructure)
+
+	user := User{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		user, exists = dbStructure.Users[id]
+		if !exists {
+			return errors.New("User not found")
+		}
+
+		emailChanged := update.Email != nil && *update.Email != user.Email
+		credentialsChanged := emailChanged || update.Password != nil
+		if credentialsChanged {
+			err := checkPassword(user, true, update.CurrentPassword)
+			if err != nil {
+				return err
+			}
+		}
+		if emailChanged {
+			if dbStructure.userExists(*update.Email) {
+				return ErrEmailTaken
+			}
+			user.Email = *update.Email
+			user.EmailVerified = false
+		}
+		if update.Password != nil {
+			user.Password = hashed_password
+		}
+		update.applyProfile(&user)
+		put(dbStructure, tableUsers, dbStructure.Users, id, user)
+		if credentialsChanged {
+			revokeUserSessions(dbStructure, id, update.KeepSession, time.Now().UTC())
+		}
+		return nil
+	})
 	if err != nil {
-		return dbStructure, err
+		return User{}, err
 	}
+	return user, nil
+}
 
-	return dbStructure, nil
+// CreateSession stores a new session together with its first refresh token.
+func (db *DB) CreateSession(session Session, token RefreshToken) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		if _, exists := dbStructure.Users[session.UserID]; !exists {
+			return errors.New("User not found")
+		}
+		token.UserID = session.UserID
+		token.FamilyID = session.ID
+		put(dbStructure, tableSessions, dbStructure.Sessions, session.ID, session)
+		put(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, token.Hash, token)
+		return nil
+	})
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// RotateRefreshToken replaces the token stored under hash with next, which
+// joins the same family. If the token was already rotated, the family is
+// revoked and ErrTokenReused is returned.
+func (db *DB) RotateRefreshToken(hash string, next RefreshToken) (RefreshToken, error) {
+	reused := false
+	err := db.Update(func(dbStructure *DBStructure) error {
+		current, exists := dbStructure.RefreshTokens[hash]
+		if !exists {
+			return ErrTokenNotFound
+		}
+		err := checkRotation(current, next)
+		if errors.Is(err, ErrTokenReused) {
+			// Returning nil keeps the revocation.
+			reused = true
+			revokeFamily(dbStructure, current.FamilyID, next.CreatedAt)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	dat, err := json.Marshal(dbStructure)
+		current.RotatedAt = next.CreatedAt
+		put(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, hash, current)
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		put(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, next.Hash, next)
+
+		session, exists := dbStructure.Sessions[current.FamilyID]
+		if exists {
+			session.LastUsedAt = next.CreatedAt
+			session.ExpiresAt = next.ExpiresAt
+			put(dbStructure, tableSessions, dbStructure.Sessions, session.ID, session)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrTokenReused
 	}
+	return next, nil
+}
+
+// RevokeRefreshToken revokes the family of the token stored under hash.
+func (db *DB) RevokeRefreshToken(hash string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		token, exists := dbStructure.RefreshTokens[hash]
+		if !exists {
+			return ErrTokenNotFound
+		}
+		revokeFamily(dbStructure, token.FamilyID, time.Now().UTC())
+		return nil
+	})
+}
+
+// GetSessions returns the active sessions of a user, most recently used
+// first.
+func (db *DB) GetSessions(userID int) ([]Session, error) {
+	sessions := []Session{}
+	now := time.Now()
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, session := range dbStructure.Sessions {
+			if session.UserID == userID && session.IsActive(now) {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, err
+}
 
-	err = os.WriteFile(db.path, dat, 0600)
+// GetSession returns a session of userID, whether or not it is still
+// active. Sessions of other users are reported as not found.
+func (db *DB) GetSession(userID int, id string) (Session, error) {
+	session := Session{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var exists bool
+		session, exists = dbStructure.Sessions[id]
+		if !exists || session.UserID != userID {
+			return ErrSessionNotFound
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return Session{}, err
 	}
-	return nil
+	return session, nil
 }
 
-func (db *DB) AuthorizeUser(email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+// RevokeSession revokes a session of userID and its refresh tokens.
+// Sessions of other users are reported as not found.
+func (db *DB) RevokeSession(userID int, id string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		session, exists := dbStructure.Sessions[id]
+		if !exists || session.UserID != userID {
+			return ErrSessionNotFound
+		}
+		revokeFamily(dbStructure, id, time.Now().UTC())
+		return nil
+	})
+}
+
+// RevokeAllSessions revokes every session and refresh token of userID and
+// returns how many sessions were active.
+func (db *DB) RevokeAllSessions(userID int) (int, error) {
+	revoked := 0
+	err := db.Update(func(dbStructure *DBStructure) error {
+		revoked = revokeUserSessions(dbStructure, userID, "", time.Now().UTC())
+		return nil
+	})
+	return revoked, err
+}
+
+// revokeUserSessions revokes every session and refresh token of userID
+// except those of the session keep, and returns how many sessions were
+// active.
+func revokeUserSessions(dbStructure *DBStructure, userID int, keep string, now time.Time) int {
+	revoked := 0
+	for id, session := range dbStructure.Sessions {
+		if session.UserID != userID || id == keep {
+			continue
+		}
+		if session.IsActive(now) {
+			revoked++
+		}
+		if session.RevokedAt.IsZero() {
+			session.RevokedAt = now
+			put(dbStructure, tableSessions, dbStructure.Sessions, id, session)
+		}
+	}
+	for hash, token := range dbStructure.RefreshTokens {
+		if token.UserID == userID && token.FamilyID != keep && token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+			put(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, hash, token)
+		}
+	}
+	return revoked
+}
+
+func revokeFamily(dbStructure *DBStructure, familyID string, now time.Time) {
+	for hash, token := range dbStructure.RefreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+			put(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, hash, token)
+		}
+	}
+	session, exists := dbStructure.Sessions[familyID]
+	if exists && session.RevokedAt.IsZero() {
+		session.RevokedAt = now
+		put(dbStructure, tableSessions, dbStructure.Sessions, familyID, session)
+	}
+}
+
+func (db *DB) CreatePasswordReset(reset PasswordReset) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		if _, exists := dbStructure.Users[reset.UserID]; !exists {
+			return errors.New("User not found")
+		}
+		put(dbStructure, tablePasswordResets, dbStructure.PasswordResets, reset.Hash, reset)
+		return nil
+	})
+}
+
+// ResetPassword sets a new password for the user of the reset token stored
+// under hash. The token and every other outstanding reset token of the user
+// are used up, and all of the user's sessions are revoked.
+func (db *DB) ResetPassword(hash, password string) (User, error) {
+	hashed_password, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return User{}, err
 	}
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-			if err == nil {
-				return user, nil
+
+	user := User{}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		reset, exists := dbStructure.PasswordResets[hash]
+		if !exists || !reset.UsedAt.IsZero() || !now.Before(reset.ExpiresAt) {
+			return ErrResetTokenInvalid
+		}
+		user, exists = dbStructure.Users[reset.UserID]
+		if !exists {
+			return ErrResetTokenInvalid
+		}
+
+		user.Password = string(hashed_password)
+		put(dbStructure, tableUsers, dbStructure.Users, user.ID, user)
+		for key, other := range dbStructure.PasswordResets {
+			if other.UserID == user.ID && other.UsedAt.IsZero() {
+				other.UsedAt = now
+				put(dbStructure, tablePasswordResets, dbStructure.PasswordResets, key, other)
+			}
+		}
+		revokeUserSessions(dbStructure, user.ID, "", now)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// DenyToken revokes the access token with the given jti until it expires.
+// Entries of tokens that have expired are pruned at the same time.
+func (db *DB) DenyToken(jti string, expiresAt time.Time) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now()
+		for id, expiry := range dbStructure.DeniedTokens {
+			if expiry.Before(now) {
+				del(dbStructure, tableDeniedTokens, dbStructure.DeniedTokens, id)
+			}
+		}
+		put(dbStructure, tableDeniedTokens, dbStructure.DeniedTokens, jti, expiresAt.UTC())
+		return nil
+	})
+}
+
+func (db *DB) IsTokenDenied(jti string) (bool, error) {
+	denied := false
+	err := db.View(func(dbStructure *DBStructure) error {
+		_, denied = dbStructure.DeniedTokens[jti]
+		return nil
+	})
+	return denied, err
+}
+
+// ConsumeToken uses up the single-use token with the given jti by adding it
+// to the deny-list until it expires. It returns ErrTokenUsed if the token
+// was used before, so two requests can't both use it.
+func (db *DB) ConsumeToken(jti string, expiresAt time.Time) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		if _, used := dbStructure.DeniedTokens[jti]; used {
+			return ErrTokenUsed
+		}
+		put(dbStructure, tableDeniedTokens, dbStructure.DeniedTokens, jti, expiresAt.UTC())
+		return nil
+	})
+}
+
+// PruneTokens removes refresh tokens, sessions and password reset tokens
+// that expired before now or were revoked or used before revokedBefore, and
+// deny-list entries of access tokens that have expired.
+func (db *DB) PruneTokens(now, revokedBefore time.Time) (PruneStats, error) {
+	stats := PruneStats{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		for hash, token := range dbStructure.RefreshTokens {
+			if prunable(token.ExpiresAt, token.RevokedAt, now, revokedBefore) {
+				del(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, hash)
+				stats.RefreshTokens++
+			}
+		}
+		for id, session := range dbStructure.Sessions {
+			if prunable(session.ExpiresAt, session.RevokedAt, now, revokedBefore) {
+				del(dbStructure, tableSessions, dbStructure.Sessions, id)
+				stats.Sessions++
+			}
+		}
+		for jti, expiry := range dbStructure.DeniedTokens {
+			if expiry.Before(now) {
+				del(dbStructure, tableDeniedTokens, dbStructure.DeniedTokens, jti)
+				stats.DeniedTokens++
+			}
+		}
+		for hash, reset := range dbStructure.PasswordResets {
+			if prunable(reset.ExpiresAt, reset.UsedAt, now, revokedBefore) {
+				del(dbStructure, tablePasswordResets, dbStructure.PasswordResets, hash)
+				stats.PasswordResets++
 			}
-			return User{}, errors.New("Password invalid.")
 		}
+		return nil
+	})
+	if err != nil {
+		return PruneStats{}, err
+	}
+	return stats, nil
+}
+
+func prunable(expiresAt, revokedAt, now, revokedBefore time.Time) bool {
+	if expiresAt.Before(now) {
+		return true
 	}
-	return User{}, errors.New("User not found.")
+	return !revokedAt.IsZero() && revokedAt.Before(revokedBefore)
 }
 
-func (db *DB) UpdateUser(id int, email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+// DeleteChirp marks a chirp as deleted. It stays in the database, hidden,
+// until PurgeChirps removes it.
+func (db *DB) DeleteChirp(chirpid int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		chirp, exists := dbStructure.Chirps[chirpid]
+		if !exists {
+			return errors.New("No Chirp")
+		}
+		if chirp.IsDeleted() {
+			return nil
+		}
+		chirp.DeletedAt = time.Now().UTC()
+		put(dbStructure, tableChirps, dbStructure.Chirps, chirpid, chirp)
+		return nil
+	})
+}
+
+// RestoreChirp undeletes a chirp that was deleted after deletedAfter, the
+// start of the restore window.
+func (db *DB) RestoreChirp(chirpid int, deletedAfter time.Time) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		chirp, exists = dbStructure.Chirps[chirpid]
+		if !exists {
+			return ErrChirpNotFound
+		}
+		if !chirp.IsDeleted() {
+			return ErrNoChange
+		}
+		if chirp.DeletedAt.Before(deletedAfter) {
+			return ErrRestoreExpired
+		}
+		chirp.DeletedAt = time.Time{}
+		put(dbStructure, tableChirps, dbStructure.Chirps, chirpid, chirp)
+		return nil
+	})
 	if err != nil {
-		return User{}, errors.New("Failed to load DB.")
+		return Chirp{}, err
 	}
+	return chirp, nil
+}
 
-	user, exists := dbStructure.Users[id]
-	if exists {
-		user.Email = email
-		hashed_password, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			return User{}, err
+// PurgeChirps permanently removes chirps deleted before cutoff, together
+// with their revisions, and returns how many were removed.
+func (db *DB) PurgeChirps(cutoff time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.IsDeleted() && chirp.DeletedAt.Before(cutoff) {
+				del(dbStructure, tableChirps, dbStructure.Chirps, id)
+				dbStructure.resolveReports(id, 0, ResolutionDeleted, purgedNote, now)
+				purged++
+			}
 		}
-		user.Password = string(hashed_password)
-		dbStructure.Users[id] = user
-		db.writeDB(dbStructure)
-		return user, nil
+		if purged == 0 {
+			return nil
+		}
+		for id, revision := range dbStructure.ChirpRevisions {
+			if _, exists := dbStructure.Chirps[revision.ChirpID]; !exists {
+				del(dbStructure, tableRevisions, dbStructure.ChirpRevisions, id)
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// UpdateChirp replaces the body of a chirp and records the new revision.
+func (db *DB) UpdateChirp(id int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		chirp, exists = dbStructure.Chirps[id]
+		if !exists {
+			return errors.New("No Chirp")
+		}
+
+		now := time.Now().UTC()
+		if len(dbStructure.revisionsOf(id)) == 0 {
+			// Chirps created before revisions were stored.
+			dbStructure.addRevision(id, chirp.Body, chirp.CreatedAt)
+		}
+		chirp.Body = body
+		chirp.UpdatedAt = now
+		put(dbStructure, tableChirps, dbStructure.Chirps, id, chirp)
+		dbStructure.addRevision(id, body, now)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
-	return User{}, errors.New("User not found")
+	return chirp, nil
 }
 
-func (db *DB) SaveRefreshToken(token string) error {
-	dbStructure, err := db.loadDB()
+// GetChirpRevisions returns every stored version of a chirp, oldest first.
+func (db *DB) GetChirpRevisions(chirpID int) ([]ChirpRevision, error) {
+	revisions := []ChirpRevision{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirp, exists := dbStructure.Chirps[chirpID]
+		if !exists {
+			return errors.New("No Chirp")
+		}
+		revisions = dbStructure.revisionsOf(chirpID)
+		if len(revisions) == 0 {
+			revisions = []ChirpRevision{{ChirpID: chirpID, Body: chirp.Body, CreatedAt: chirp.CreatedAt}}
+		}
+		return nil
+	})
+	return revisions, err
+}
+
+// CountChirps returns how many chirps by the author are visible.
+func (db *DB) CountChirps(authorID int) (int, error) {
+	count := 0
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, chirp := range dbStructure.Chirps {
+			if chirp.AuthorID == authorID && chirp.IsVisible() {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// removeChirp deletes a chirp and its revisions for good.
+func (db *DBStructure) removeChirp(id int) {
+	for _, revision := range db.revisionsOf(id) {
+		del(db, tableRevisions, db.ChirpRevisions, revision.ID)
+	}
+	del(db, tableChirps, db.Chirps, id)
+}
+
+func (db *DBStructure) addRevision(chirpID int, body string, createdAt time.Time) {
+	id := db.nextID(tableRevisions)
+	put(db, tableRevisions, db.ChirpRevisions, id, ChirpRevision{
+		ID:        id,
+		ChirpID:   chirpID,
+		Body:      body,
+		CreatedAt: createdAt,
+	})
+}
+
+func (db *DBStructure) revisionsOf(chirpID int) []ChirpRevision {
+	revisions := []ChirpRevision{}
+	for _, revision := range db.ChirpRevisions {
+		if revision.ChirpID == chirpID {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ID < revisions[j].ID
+	})
+	return revisions
+}
+
+// DeleteUser permanently removes a user together with their chirps,
+// revisions, sessions and tokens, after checking their password.
+func (db *DB) DeleteUser(id int, password string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, exists := dbStructure.Users[id]
+		if !exists {
+			return errors.New("User not found")
+		}
+		err := checkPassword(user, true, password)
+		if err != nil {
+			return err
+		}
+
+		for reportID, report := range dbStructure.Reports {
+			chirp := dbStructure.Chirps[report.ChirpID]
+			if report.ReporterID == id || chirp.AuthorID == id {
+				del(dbStructure, tableReports, dbStructure.Reports, reportID)
+			}
+		}
+		for chirpID, chirp := range dbStructure.Chirps {
+			if chirp.AuthorID == id {
+				dbStructure.removeChirp(chirpID)
+			}
+		}
+		for sessionID, session := range dbStructure.Sessions {
+			if session.UserID == id {
+				del(dbStructure, tableSessions, dbStructure.Sessions, sessionID)
+			}
+		}
+		for hash, token := range dbStructure.RefreshTokens {
+			if token.UserID == id {
+				del(dbStructure, tableRefreshTokens, dbStructure.RefreshTokens, hash)
+			}
+		}
+		for hash, reset := range dbStructure.PasswordResets {
+			if reset.UserID == id {
+				del(dbStructure, tablePasswordResets, dbStructure.PasswordResets, hash)
+			}
+		}
+		del(dbStructure, tableUsers, dbStructure.Users, id)
+		return nil
+	})
+}
+
+func (db *DB) ExportUser(id int) (UserData, error) {
+	data := UserData{
+		Chirps:         []Chirp{},
+		ChirpRevisions: []ChirpRevision{},
+		Sessions:       []Session{},
+		RefreshTokens:  []RefreshToken{},
+		PasswordResets: []PasswordReset{},
+		Reports:        []Report{},
+		ModerationLog:  []ModerationEntry{},
+	}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var exists bool
+		data.User, exists = dbStructure.Users[id]
+		if !exists {
+			return errors.New("User not found")
+		}
+		for chirpID, chirp := range dbStructure.Chirps {
+			if chirp.AuthorID == id {
+				data.Chirps = append(data.Chirps, chirp)
+				data.ChirpRevisions = append(data.ChirpRevisions, dbStructure.revisionsOf(chirpID)...)
+			}
+		}
+		for _, session := range dbStructure.Sessions {
+			if session.UserID == id {
+				data.Sessions = append(data.Sessions, session)
+			}
+		}
+		for _, token := range dbStructure.RefreshTokens {
+			if token.UserID == id {
+				data.RefreshTokens = append(data.RefreshTokens, token)
+			}
+		}
+		for _, reset := range dbStructure.PasswordResets {
+			if reset.UserID == id {
+				data.PasswordResets = append(data.PasswordResets, reset)
+			}
+		}
+		for _, report := range dbStructure.Reports {
+			if report.ReporterID == id {
+				data.Reports = append(data.Reports, report)
+			}
+		}
+		for _, entry := range dbStructure.ModerationLog {
+			if entry.UserID == id {
+				data.ModerationLog = append(data.ModerationLog, entry)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.New("Failed to load DB.")
+		return UserData{}, err
 	}
-	dbStructure.Revocations[token] = Revocation{Token: token, RevokedAt: time.Time{}}
 
-	err = db.writeDB(dbStructure)
+	sort.Slice(data.Chirps, func(i, j int) bool { return data.Chirps[i].ID < data.Chirps[j].ID })
+	sort.Slice(data.ChirpRevisions, func(i, j int) bool { return data.ChirpRevisions[i].ID < data.ChirpRevisions[j].ID })
+	sort.Slice(data.Sessions, func(i, j int) bool { return data.Sessions[i].CreatedAt.Before(data.Sessions[j].CreatedAt) })
+	sort.Slice(data.RefreshTokens, func(i, j int) bool { return data.RefreshTokens[i].CreatedAt.Before(data.RefreshTokens[j].CreatedAt) })
+	sort.Slice(data.PasswordResets, func(i, j int) bool { return data.PasswordResets[i].CreatedAt.Before(data.PasswordResets[j].CreatedAt) })
+	sort.Slice(data.Reports, func(i, j int) bool { return data.Reports[i].ID < data.Reports[j].ID })
+	sort.Slice(data.ModerationLog, func(i, j int) bool { return data.ModerationLog[i].ID < data.ModerationLog[j].ID })
+	return data, nil
+}
+
+// VerifyEmail marks the email of a user as verified, provided it is still
+// the address the verification was sent to.
+func (db *DB) VerifyEmail(userID int, email string) (User, error) {
+	user := User{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		user, exists = dbStructure.Users[userID]
+		if !exists {
+			return errors.New("User not found")
+		}
+		if user.Email != email {
+			return ErrEmailChanged
+		}
+		user.EmailVerified = true
+		put(dbStructure, tableUsers, dbStructure.Users, userID, user)
+		return nil
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
+	return user, nil
+}
 
-	return nil
+// CountUsers returns how many users have the role.
+func (db *DB) CountUsers(role Role) (int, error) {
+	count := 0
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, user := range dbStructure.Users {
+			if user.Role == role {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
 }
 
-func (db *DB) IsRevoked(token string) (bool, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) SetUserRole(id int, role Role) (User, error) {
+	user := User{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		user, exists = dbStructure.Users[id]
+		if !exists {
+			return errors.New("User doesn't exist")
+		}
+		user.Role = role
+		put(dbStructure, tableUsers, dbStructure.Users, id, user)
+		return nil
+	})
 	if err != nil {
-		return false, errors.New("Failed to load DB.")
+		return User{}, err
 	}
+	return user, nil
+}
 
-	revocation, exists := dbStructure.Revocations[token]
+// ModerateChirp hides, unhides or permanently deletes the chirp named by
+// entry and records entry in the moderation log.
+func (db *DB) ModerateChirp(entry ModerationEntry) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var err error
+		chirp, err = dbStructure.moderateChirp(entry, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (db *DBStructure) moderateChirp(entry ModerationEntry, now time.Time) (Chirp, error) {
+	chirp, exists := db.Chirps[entry.ChirpID]
 	if !exists {
-		return false, errors.New("This token is not in the DB.")
+		return Chirp{}, ErrChirpNotFound
 	}
 
-	if revocation.RevokedAt.IsZero() {
-		return true, nil
+	switch entry.Action {
+	case ActionHideChirp:
+		if chirp.IsHidden() {
+			return Chirp{}, ErrNoChange
+		}
+		chirp.HiddenAt = now
+		chirp.HiddenReason = entry.Reason
+		put(db, tableChirps, db.Chirps, chirp.ID, chirp)
+	case ActionUnhideChirp:
+		if !chirp.IsHidden() {
+			return Chirp{}, ErrNoChange
+		}
+		chirp.HiddenAt = time.Time{}
+		chirp.HiddenReason = ""
+		put(db, tableChirps, db.Chirps, chirp.ID, chirp)
+	case ActionDeleteChirp:
+		db.removeChirp(chirp.ID)
+		db.resolveReports(chirp.ID, entry.ModeratorID, ResolutionDeleted, entry.Reason, now)
+	default:
+		return Chirp{}, fmt.Errorf("%q is not a chirp action", entry.Action)
 	}
 
-	return false, nil
+	entry.UserID = chirp.AuthorID
+	entry.CreatedAt = now
+	db.logModeration(entry)
+	return chirp, nil
 }
 
-func (db *DB) RevokeToken(token string) error {
-	dbStructure, err := db.loadDB()
+// ModerateUser suspends or unsuspends the user named by entry and records
+// entry in the moderation log. Suspending a user signs them out everywhere.
+func (db *DB) ModerateUser(entry ModerationEntry) (User, error) {
+	user := User{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var exists bool
+		user, exists = dbStructure.Users[entry.UserID]
+		if !exists {
+			return ErrUserNotFound
+		}
+
+		now := time.Now().UTC()
+		switch entry.Action {
+		case ActionSuspendUser:
+			if user.IsSuspended() {
+				return ErrNoChange
+			}
+			user.SuspendedAt = now
+			user.SuspendedReason = entry.Reason
+			revokeUserSessions(dbStructure, user.ID, "", now)
+		case ActionUnsuspendUser:
+			if !user.IsSuspended() {
+				return ErrNoChange
+			}
+			user.SuspendedAt = time.Time{}
+			user.SuspendedReason = ""
+		default:
+			return fmt.Errorf("%q is not a user action", entry.Action)
+		}
+		put(dbStructure, tableUsers, dbStructure.Users, user.ID, user)
+
+		entry.ChirpID = 0
+		entry.CreatedAt = now
+		dbStructure.logModeration(entry)
+		return nil
+	})
 	if err != nil {
-		return errors.New("Failed to load DB.")
+		return User{}, err
 	}
+	return user, nil
+}
+
+func (db *DBStructure) logModeration(entry ModerationEntry) {
+	entry.ID = db.nextID(tableModerationLog)
+	put(db, tableModerationLog, db.ModerationLog, entry.ID, entry)
+}
 
-	revocation, exists := dbStructure.Revocations[token]
-	if exists {
-		revocation.RevokedAt = time.Now()
-		dbStructure.Revocations[token] = revocation
-		db.writeDB(dbStructure)
+// GetModerationLog returns a page of the moderation log, newest first, and
+// the cursor for the next page, or zero if this is the last one.
+func (db *DB) GetModerationLog(query ModerationLogQuery) ([]ModerationEntry, int, error) {
+	entries := []ModerationEntry{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, entry := range dbStructure.ModerationLog {
+			if query.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
 	}
 
-	dbStructure, err = db.loadDB()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+
+	next := 0
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		next = entries[len(entries)-1].ID
+	}
+	return entries, next, nil
+}
+
+// CreateReport files a report against a visible chirp. Each user can report
+// a chirp once. When hideAfter is positive and the chirp then has that many
+// open reports, it is hidden and CreateReport reports true.
+func (db *DB) CreateReport(report Report, hideAfter int) (Report, bool, error) {
+	hidden := false
+	err := db.Update(func(dbStructure *DBStructure) error {
+		chirp, exists := dbStructure.Chirps[report.ChirpID]
+		if !exists || !chirp.IsVisible() {
+			return errors.New("No Chirp")
+		}
+
+		open := 0
+		for _, other := range dbStructure.Reports {
+			if other.ChirpID != report.ChirpID {
+				continue
+			}
+			if other.ReporterID == report.ReporterID {
+				return ErrAlreadyReported
+			}
+			if !other.IsResolved() {
+				open++
+			}
+		}
+
+		now := time.Now().UTC()
+		report.ID = dbStructure.nextID(tableReports)
+		report.CreatedAt = now
+		put(dbStructure, tableReports, dbStructure.Reports, report.ID, report)
+
+		open++
+		if hideAfter > 0 && open >= hideAfter {
+			_, err := dbStructure.moderateChirp(autoHideEntry(chirp.ID, open), now)
+			if err != nil {
+				return err
+			}
+			hidden = true
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.New("Failed to load DB.")
+		return Report{}, false, err
 	}
-	return nil
+	return report, hidden, nil
 }
 
-func (db *DB) DeleteChirp(chirpid int) error {
-	dbStructure, err := db.loadDB()
+// GetReports returns a page of reports, oldest first, and the cursor for
+// the next page, or zero if this is the last one.
+func (db *DB) GetReports(query ReportQuery) ([]Report, int, error) {
+	reports := []Report{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, report := range dbStructure.Reports {
+			if query.matches(report) {
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.New("Failed to load DB.")
+		return nil, 0, err
 	}
-	
-	delete(dbStructure.Chirps, chirpid) 
-	db.writeDB(dbStructure)
 
-	return nil
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+
+	next := 0
+	if query.Limit > 0 && len(reports) > query.Limit {
+		reports = reports[:query.Limit]
+		next = reports[len(reports)-1].ID
+	}
+	return reports, next, nil
 }
 
-func (db *DB) UpgradeChirpyRed(user_id int) (int, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return user_id, errors.New("Failed to load DB.")
-	}
-	
-	user, exists := dbStructure.Users[user_id]
-	if exists == false {
-		return user_id, errors.New("User doesn't exist")
-	}
-	
-	user.IsChirpyRed = true
-	dbStructure.Users[user_id] = user
-	db.writeDB(dbStructure)
-	return user_id, nil
+// ResolveReports closes every open report on a chirp and returns how many
+// there were. The chirp is also hidden or deleted, or, when the reports are
+// dismissed, unhidden if the reports hid it automatically. That is
+// recorded in the moderation log with note as the reason.
+func (db *DB) ResolveReports(chirpID, resolverID int, resolution Resolution, note string) (int, error) {
+	resolved := 0
+	err := db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		resolved = dbStructure.resolveReports(chirpID, resolverID, resolution, note, now)
+		if resolved == 0 {
+			return ErrNoChange
+		}
+		// A chirp that is already gone needs no further action.
+		chirp, exists := dbStructure.Chirps[chirpID]
+		if !exists {
+			return nil
+		}
+		if resolution == ResolutionDismissed && !dbStructure.autoHidden(chirp) {
+			return nil
+		}
+		entry := resolution.entry(chirpID, resolverID, note)
+		if resolution == ResolutionHidden && chirp.IsHidden() {
+			dbStructure.confirmHide(chirp, entry, now)
+			return nil
+		}
+		_, err := dbStructure.moderateChirp(entry, now)
+		if errors.Is(err, ErrNoChange) {
+			return nil
+		}
+		return err
+	})
+	return resolved, err
+}
+
+// confirmHide records a moderator's hide of a chirp that is already hidden,
+// typically by reports, and takes over its reason. The chirp then counts as
+// hidden by the moderator, so dismissing later reports won't unhide it.
+func (db *DBStructure) confirmHide(chirp Chirp, entry ModerationEntry, now time.Time) {
+	chirp.HiddenReason = entry.Reason
+	put(db, tableChirps, db.Chirps, chirp.ID, chirp)
+	entry.UserID = chirp.AuthorID
+	entry.CreatedAt = now
+	db.logModeration(entry)
+}
+
+// autoHidden reports whether chirp is hidden because of reports rather
+// than by a moderator: its latest hide has no moderator.
+func (db *DBStructure) autoHidden(chirp Chirp) bool {
+	if !chirp.IsHidden() {
+		return false
+	}
+	latest := ModerationEntry{}
+	for _, entry := range db.ModerationLog {
+		if entry.ChirpID == chirp.ID && entry.Action == ActionHideChirp && entry.ID > latest.ID {
+			latest = entry
+		}
+	}
+	return latest.ID != 0 && latest.ModeratorID == 0
+}
+
+func (db *DBStructure) resolveReports(chirpID, resolverID int, resolution Resolution, note string, now time.Time) int {
+	resolved := 0
+	for id, report := range db.Reports {
+		if report.ChirpID != chirpID || report.IsResolved() {
+			continue
+		}
+		report.ResolvedAt = now
+		report.ResolverID = resolverID
+		report.Resolution = resolution
+		report.Note = note
+		put(db, tableReports, db.Reports, id, report)
+		resolved++
+	}
+	return resolved
+}
+
+// ProcessChirpyRedEvent sets the Chirpy Red status of a user and records the
+// webhook event in the same transaction, so a retried event is applied
+// only once. Events without an ID aren't recorded. Recorded IDs are never
+// pruned, so a captured request can't be replayed later.
+func (db *DB) ProcessChirpyRedEvent(eventID string, userID int, isChirpyRed bool) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		if _, processed := dbStructure.Webhooks[eventID]; processed && eventID != "" {
+			return ErrEventProcessed
+		}
+		user, exists := dbStructure.Users[userID]
+		if !exists {
+			return ErrUserNotFound
+		}
+
+		user.IsChirpyRed = isChirpyRed
+		put(dbStructure, tableUsers, dbStructure.Users, userID, user)
+		if eventID != "" {
+			put(dbStructure, tableWebhooks, dbStructure.Webhooks, eventID, time.Now().UTC())
+		}
+		return nil
+	})
 }
@@ -0,0 +1,16 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDB(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) Store {
+		db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
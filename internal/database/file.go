@@ -0,0 +1,574 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Options controls how DB persists its in-memory dataset.
+type Options struct {
+	// FlushInterval is how often pending changes are appended to the
+	// journal. Zero makes every Update write the journal before returning;
+	// negative values are rejected.
+	FlushInterval time.Duration
+	// CompactAfter is the number of journal entries after which the journal
+	// is folded into the snapshot file. Defaults to 1000.
+	CompactAfter int
+}
+
+const defaultCompactAfter = 1000
+
+// journalEntry records a single put (Value set) or delete (Value nil) of one
+// row. Entries are stored as JSON lines in <path>.journal and replayed over
+// the snapshot at startup.
+type journalEntry struct {
+	Table string          `json:"table"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type change struct {
+	entry journalEntry
+	undo  func()
+}
+
+// Update runs fn inside a write transaction against the in-memory dataset.
+// fn must make its changes through put and del so they can be journaled; if
+// fn returns an error every change it made is rolled back. With a zero
+// FlushInterval the changes are journaled before Update returns, and rolled
+// back as well if that fails.
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	writeThrough := db.opts.FlushInterval == 0
+	if writeThrough {
+		db.flushMu.Lock()
+		defer db.flushMu.Unlock()
+	}
+
+	db.mu.Lock()
+	db.data.changes = nil
+	err := fn(&db.data)
+	if err == nil {
+		err = db.data.changeErr
+	}
+	changes := db.data.changes
+	db.data.changes = nil
+	db.data.changeErr = nil
+
+	entries := make([]journalEntry, 0, len(changes))
+	for _, c := range changes {
+		entries = append(entries, c.entry)
+	}
+	if err == nil && writeThrough && len(entries) > 0 {
+		// Readers wait for the journal here, so they never see a change
+		// that might still be rolled back.
+		err = db.appendJournal(entries)
+	}
+	if err != nil {
+		for i := len(changes) - 1; i >= 0; i-- {
+			changes[i].undo()
+		}
+		db.mu.Unlock()
+		return err
+	}
+	if !writeThrough {
+		db.pending = append(db.pending, entries...)
+	}
+	db.mu.Unlock()
+
+	if writeThrough && db.journalEntries >= db.opts.CompactAfter {
+		// The change is already journaled; a failed compaction is retried
+		// by the next Update.
+		err = db.compact()
+		if err != nil {
+			log.Printf("Failed to compact database: %v", err)
+		}
+	}
+	return nil
+}
+
+// View runs fn with read access to the in-memory dataset. fn must not modify
+// it or keep references to it after returning.
+func (db *DB) View(fn func(*DBStructure) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return fn(&db.data)
+}
+
+// Flush appends pending changes to the journal and fsyncs it, compacting
+// the journal into the snapshot once it grows past Options.CompactAfter.
+func (db *DB) Flush() error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	err := db.flushPending()
+	if err != nil {
+		return err
+	}
+
+	if db.journalEntries >= db.opts.CompactAfter {
+		return db.compact()
+	}
+	return nil
+}
+
+// flushPending appends pending changes to the journal. Callers must hold
+// db.flushMu.
+func (db *DB) flushPending() error {
+	db.mu.Lock()
+	pending := db.pending
+	db.pending = nil
+	db.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	err := db.appendJournal(pending)
+	if err != nil {
+		// Keep the entries so the next flush retries them.
+		db.mu.Lock()
+		db.pending = append(pending, db.pending...)
+		db.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops the background flusher and folds everything into the snapshot.
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.done)
+	})
+	db.wg.Wait()
+
+	err := db.Flush()
+	if err != nil {
+		return err
+	}
+
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	err = db.compact()
+	if closeErr := db.journal.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := db.Flush()
+			if err != nil {
+				log.Printf("Failed to flush database: %v", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// put sets m[key] = value and records the change for the journal.
+func put[K comparable, V any](s *DBStructure, table string, m map[K]V, key K, value V) {
+	old, existed := m[key]
+	m[key] = value
+	s.record(table, key, &value, func() {
+		if existed {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// del removes m[key] and records the change for the journal.
+func del[K comparable, V any](s *DBStructure, table string, m map[K]V, key K) {
+	old, existed := m[key]
+	if !existed {
+		return
+	}
+	delete(m, key)
+	s.record(table, key, nil, func() {
+		m[key] = old
+	})
+}
+
+func (s *DBStructure) record(table string, key, value any, undo func()) {
+	entry := journalEntry{Table: table}
+	var err error
+	entry.Key, err = json.Marshal(key)
+	if err == nil && value != nil {
+		entry.Value, err = json.Marshal(value)
+	}
+	if err != nil && s.changeErr == nil {
+		s.changeErr = err
+	}
+	s.changes = append(s.changes, change{entry: entry, undo: undo})
+}
+
+// apply replays a journal entry onto m.
+func apply[K comparable, V any](m map[K]V, entry journalEntry) error {
+	var key K
+	err := json.Unmarshal(entry.Key, &key)
+	if err != nil {
+		return err
+	}
+	if entry.Value == nil {
+		delete(m, key)
+		return nil
+	}
+	var value V
+	err = json.Unmarshal(entry.Value, &value)
+	if err != nil {
+		return err
+	}
+	m[key] = value
+	return nil
+}
+
+func (s *DBStructure) apply(entry journalEntry) error {
+	switch entry.Table {
+	case tableChirps:
+		return apply(s.Chirps, entry)
+	case tableUsers:
+		return apply(s.Users, entry)
+	case tableRefreshTokens:
+		return apply(s.RefreshTokens, entry)
+	case tableWebhooks:
+		return apply(s.Webhooks, entry)
+	case tableSequences:
+		return apply(s.Sequences, entry)
+	case tableRevisions:
+		return apply(s.ChirpRevisions, entry)
+	case tableSessions:
+		return apply(s.Sessions, entry)
+	case tableDeniedTokens:
+		return apply(s.DeniedTokens, entry)
+	case tablePasswordResets:
+		return apply(s.PasswordResets, entry)
+	case tableModerationLog:
+		return apply(s.ModerationLog, entry)
+	case tableReports:
+		return apply(s.Reports, entry)
+	}
+	return fmt.Errorf("unknown table %q in journal", entry.Table)
+}
+
+func (db *DB) journalPath() string {
+	return db.path + ".journal"
+}
+
+// open loads the snapshot, replays the journal over it and opens the
+// journal for appending.
+func (db *DB) open() error {
+	dbStructure, err := loadSnapshot(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		dbStructure.init()
+		err = writeSnapshot(db.path, dbStructure)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := replayJournal(db.journalPath(), &dbStructure)
+	if err != nil {
+		return err
+	}
+	dbStructure.seedSequences()
+	dbStructure.dropPlaintextTokens()
+	dbStructure.defaultRoles()
+
+	db.journal, err = os.OpenFile(db.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	db.data = dbStructure
+	db.journalEntries = n
+	return nil
+}
+
+// replayJournal applies the journal at path to dbStructure and returns the
+// number of entries applied. A torn final line, left by a crash during an
+// append, is discarded.
+func replayJournal(path string, dbStructure *DBStructure) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Discarding incomplete journal entry in %s", path)
+				return n, f.Truncate(offset)
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		entry := journalEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return n, fmt.Errorf("corrupt journal entry at offset %d: %w", offset, err)
+		}
+		err = dbStructure.apply(entry)
+		if err != nil {
+			return n, err
+		}
+		offset += int64(len(line))
+		n++
+	}
+}
+
+func (db *DB) appendJournal(entries []journalEntry) error {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		err := encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := db.journal.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = db.journal.Write(buf.Bytes())
+	if err == nil {
+		err = db.journal.Sync()
+	}
+	if err != nil {
+		// Drop a partial write so that retried entries start on a fresh
+		// line.
+		db.journal.Truncate(info.Size())
+		return err
+	}
+	db.journalEntries += len(entries)
+	return nil
+}
+
+// compact writes the in-memory dataset as the new snapshot and empties the
+// journal. Pending entries are flushed first, so the snapshot holds no
+// change that wasn't journaled; entries recorded after that are still
+// pending and will be appended to the fresh journal. Callers must hold
+// db.flushMu.
+func (db *DB) compact() error {
+	err := db.flushPending()
+	if err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	dat, err := json.Marshal(db.data)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(db.path, dat)
+	if err != nil {
+		return err
+	}
+
+	err = db.journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	db.journalEntries = 0
+	return db.journal.Sync()
+}
+
+// init fills in collections that are missing from older database files.
+func (dbStructure *DBStructure) init() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbStructure.Webhooks == nil {
+		dbStructure.Webhooks = map[string]time.Time{}
+	}
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]int{}
+	}
+	if dbStructure.ChirpRevisions == nil {
+		dbStructure.ChirpRevisions = map[int]ChirpRevision{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[string]Session{}
+	}
+	if dbStructure.DeniedTokens == nil {
+		dbStructure.DeniedTokens = map[string]time.Time{}
+	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = map[string]PasswordReset{}
+	}
+	if dbStructure.ModerationLog == nil {
+		dbStructure.ModerationLog = map[int]ModerationEntry{}
+	}
+	if dbStructure.Reports == nil {
+		dbStructure.Reports = map[int]Report{}
+	}
+}
+
+// defaultRoles makes users saved before roles existed plain users. They are
+// written with the role at the next compaction.
+func (dbStructure *DBStructure) defaultRoles() {
+	for id, user := range dbStructure.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			dbStructure.Users[id] = user
+		}
+	}
+}
+
+// dropPlaintextTokens removes refresh tokens stored by older versions, which
+// kept the JWT itself as the key. They are gone from the file at the next
+// compaction.
+func (dbStructure *DBStructure) dropPlaintextTokens() {
+	for key, token := range dbStructure.RefreshTokens {
+		if token.Hash == "" {
+			delete(dbStructure.RefreshTokens, key)
+		}
+	}
+}
+
+func loadSnapshot(path string) (DBStructure, error) {
+	dbStructure := DBStructure{}
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return dbStructure, err
+	}
+	err = json.Unmarshal(dat, &dbStructure)
+	if err != nil {
+		return dbStructure, err
+	}
+	dbStructure.init()
+
+	return dbStructure, nil
+}
+
+func writeSnapshot(path string, dbStructure DBStructure) error {
+	dat, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, dat)
+}
+
+// writeFileAtomic replaces path atomically: dat is written to a temporary
+// file and fsynced, the current file is kept as a backup, and the temporary
+// file is renamed over it. A crash at any point leaves either the old or the
+// new contents in place.
+func writeFileAtomic(path string, dat []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = backup(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// backup rotates the current contents of path into <path>.bak, replacing the
+// previous backup.
+func backup(path string) error {
+	backupPath := path + ".bak"
+	err := os.Remove(backupPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Link(path, backupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+	// Hard links aren't available on every filesystem; fall back to a copy.
+	return copyFile(path, backupPath)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes a rename to disk by fsyncing the containing directory.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
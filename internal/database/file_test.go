@@ -0,0 +1,494 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, path string, opts Options) *DB {
+	t.Helper()
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// crash stops db the way a killed process would: pending changes are lost
+// and the journal isn't compacted.
+func crash(t *testing.T, db *DB) {
+	t.Helper()
+	db.closeOnce.Do(func() {
+		close(db.done)
+	})
+	db.wg.Wait()
+	err := db.journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{})
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.CreateChirp("first", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateChirp("second", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, db)
+
+	db = openTestDB(t, path, Options{})
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].ID != second.ID {
+		t.Errorf("chirps after replay = %+v, want only chirp %d", chirps, second.ID)
+	}
+	if _, err := db.AuthorizeUser("a@example.com", "password"); err != nil {
+		t.Errorf("user lost during replay: %v", err)
+	}
+}
+
+func TestJournalReplayDamage(t *testing.T) {
+	tests := []struct {
+		name string
+		// tail is appended to a journal holding one user.
+		tail    string
+		wantErr bool
+	}{
+		{name: "intact"},
+		{name: "torn final entry", tail: `{"table":"chirps","key":1,"val`},
+		{name: "unknown table", tail: `{"table":"nope","key":1}` + "\n", wantErr: true},
+		{name: "corrupt entry", tail: "not json\n" + `{"table":"chirps","key":1}` + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDB(t, path, Options{})
+			_, err := db.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			crash(t, db)
+
+			intact := fileSize(t, path+".journal")
+			f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteString(tt.tail)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = NewDB(path, Options{})
+			if tt.wantErr {
+				if err == nil {
+					db.Close()
+					t.Fatal("NewDB() accepted a damaged journal")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if _, err := db.AuthorizeUser("a@example.com", "password"); err != nil {
+				t.Errorf("user lost during replay: %v", err)
+			}
+			if size := fileSize(t, path+".journal"); size != intact {
+				t.Errorf("journal is %d bytes after replay, want %d", size, intact)
+			}
+		})
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{CompactAfter: 10})
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user journals two entries and each chirp four: the chirp, its
+	// revision and two sequences, so the second chirp compacts.
+	for i := 0; i < 2; i++ {
+		_, err = db.CreateChirp("chirp", user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := fileSize(t, path+".journal"); size != 0 || db.journalEntries != 0 {
+		t.Errorf("journal holds %d entries (%d bytes) after compaction, want 0", db.journalEntries, size)
+	}
+
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Chirps) != 2 || len(snapshot.Users) != 1 {
+		t.Errorf("snapshot has %d chirps and %d users, want 2 and 1", len(snapshot.Chirps), len(snapshot.Users))
+	}
+	if _, err := os.Stat(path + ".bak"); err != nil {
+		t.Errorf("no backup of the previous snapshot: %v", err)
+	}
+	crash(t, db)
+
+	// The snapshot alone must be enough after a crash.
+	db = openTestDB(t, path, Options{})
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("%d chirps after reopening, want 2", len(chirps))
+	}
+}
+
+func TestCompactionFlushesPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{FlushInterval: time.Hour})
+	defer db.Close()
+	_, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.flushMu.Lock()
+	err = db.compact()
+	db.flushMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.pending) != 0 {
+		t.Errorf("%d entries still pending after compaction, want 0", len(db.pending))
+	}
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Users) != 1 {
+		t.Errorf("snapshot has %d users, want 1", len(snapshot.Users))
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{FlushInterval: time.Hour})
+	_, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, path+".journal"); size != 0 {
+		t.Errorf("journal is %d bytes before the flush interval, want 0", size)
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, path+".journal"); size == 0 {
+		t.Error("Flush() didn't write the journal")
+	}
+
+	_, err = db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Users) != 2 {
+		t.Errorf("snapshot has %d users after Close, want 2", len(snapshot.Users))
+	}
+	if size := fileSize(t, path+".journal"); size != 0 {
+		t.Errorf("journal is %d bytes after Close, want 0", size)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{})
+	defer db.Close()
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFail := errors.New("fail")
+	err = db.Update(func(dbStructure *DBStructure) error {
+		put(dbStructure, tableChirps, dbStructure.Chirps, 1, Chirp{ID: 1, AuthorID: user.ID})
+		del(dbStructure, tableUsers, dbStructure.Users, user.ID)
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatalf("Update() error = %v, want %v", err, errFail)
+	}
+	if _, err := db.GetChirpById(1); err == nil {
+		t.Error("chirp put by a failed update is still there")
+	}
+	if _, err := db.AuthorizeUser("a@example.com", "password"); err != nil {
+		t.Error("user deleted by a failed update is gone")
+	}
+	if len(db.pending) != 0 {
+		t.Errorf("failed update left %d pending journal entries", len(db.pending))
+	}
+}
+
+func TestUpdateJournalFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{})
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only handle makes every journal write fail.
+	journal := db.journal
+	db.journal, err = os.Open(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("lost", user.ID)
+	db.journal.Close()
+	db.journal = journal
+	if err == nil {
+		t.Fatal("CreateChirp() succeeded although the journal couldn't be written")
+	}
+	if chirps, err := db.GetChirps(); err != nil || len(chirps) != 0 {
+		t.Errorf("GetChirps() = %v, %v after a failed write, want none", chirps, err)
+	}
+
+	chirp, err := db.CreateChirp("kept", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, db)
+	db = openTestDB(t, path, Options{})
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].ID != chirp.ID || chirps[0].Body != "kept" {
+		t.Errorf("chirps after reopening = %+v, want only %q", chirps, "kept")
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, Options{})
+
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.CreateSession(Session{ID: fmt.Sprint(i), UserID: user.ID}, RefreshToken{Hash: fmt.Sprint(i)})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	crash(t, db)
+
+	db = openTestDB(t, path, Options{})
+	defer db.Close()
+	db.View(func(dbStructure *DBStructure) error {
+		for i := 0; i < n; i++ {
+			if _, exists := dbStructure.RefreshTokens[fmt.Sprint(i)]; !exists {
+				t.Errorf("token %d lost", i)
+			}
+		}
+		return nil
+	})
+}
+
+func TestSequencesSeeded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	// A file written before sequences were stored, with a gap at chirp 2.
+	snapshot := DBStructure{
+		Users:          map[int]User{1: {ID: 1, Email: "a@example.com"}, 2: {ID: 2, Email: "b@example.com"}},
+		Chirps:         map[int]Chirp{1: {ID: 1, AuthorID: 1}, 3: {ID: 3, AuthorID: 1}},
+		ChirpRevisions: map[int]ChirpRevision{5: {ID: 5, ChirpID: 3}},
+		ModerationLog:  map[int]ModerationEntry{7: {ID: 7, Action: ActionHideChirp, ChirpID: 3}},
+		Reports:        map[int]Report{2: {ID: 2, ChirpID: 3, ReporterID: 2, Reason: ReasonSpam}},
+	}
+	err := writeSnapshot(path, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t, path, Options{})
+	defer db.Close()
+	chirp, err := db.CreateChirp("new", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 4 {
+		t.Errorf("new chirp ID = %d, want 4", chirp.ID)
+	}
+	revisions, err := db.GetChirpRevisions(chirp.ID)
+	if err != nil || len(revisions) != 1 || revisions[0].ID != 6 {
+		t.Errorf("new revisions = %+v, %v; want ID 6", revisions, err)
+	}
+	report, _, err := db.CreateReport(Report{ChirpID: chirp.ID, ReporterID: 2, Reason: ReasonSpam}, 0)
+	if err != nil || report.ID != 3 {
+		t.Errorf("new report ID = %d, %v; want 3", report.ID, err)
+	}
+	_, err = db.ModerateChirp(ModerationEntry{ModeratorID: 2, Action: ActionHideChirp, ChirpID: chirp.ID, Reason: "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := db.GetModerationLog(ModerationLogQuery{ChirpID: chirp.ID})
+	if err != nil || len(entries) != 1 || entries[0].ID != 8 {
+		t.Errorf("new moderation log entries = %+v, %v; want ID 8", entries, err)
+	}
+}
+
+func TestNewDBOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	_, err := NewDB(path, Options{FlushInterval: -time.Second})
+	if err == nil {
+		t.Error("NewDB() accepted a negative flush interval")
+	}
+}
+
+func TestDefaultRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	// A user saved before roles existed.
+	snapshot := DBStructure{
+		Users: map[int]User{1: {ID: 1, Email: "a@example.com"}},
+	}
+	err := writeSnapshot(path, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t, path, Options{})
+	defer db.Close()
+	user, err := db.GetUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUser {
+		t.Errorf("role = %q, want %q", user.Role, RoleUser)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	snapshot := DBStructure{
+		Users: map[int]User{
+			2: {ID: 1, Email: "b@example.com"},
+			3: {ID: 3, Email: "a@example.com"},
+			4: {ID: 4, Email: "a@example.com"},
+		},
+		Chirps: map[int]Chirp{
+			1: {ID: 1, AuthorID: 2},
+			3: {ID: 1, AuthorID: 3},
+			4: {ID: 4, AuthorID: 9},
+		},
+	}
+	dat, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, dat, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"chirps: chirp 4 belongs to missing user 9",
+		"chirps: chirp stored under 3 has ID 1",
+		"chirps: no sequence stored and the next ID 4 is already taken",
+		"users: email a@example.com is used by users [3 4]",
+		"users: no sequence stored and the next ID 4 is already taken",
+		"users: user stored under 2 has ID 1",
+	}
+	if len(report.Problems) != len(want) {
+		t.Fatalf("Repair() problems = %q, want %q", report.Problems, want)
+	}
+	for i := range want {
+		if report.Problems[i] != want[i] {
+			t.Errorf("problem %d = %q, want %q", i, report.Problems[i], want[i])
+		}
+	}
+	if report.Fixed {
+		t.Error("Repair() without fix reports Fixed")
+	}
+
+	report, err = Repair(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Fixed {
+		t.Error("Repair() with fix doesn't report Fixed")
+	}
+	fixed, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, chirp := range fixed.Chirps {
+		if key != chirp.ID {
+			t.Errorf("chirp stored under %d still has ID %d", key, chirp.ID)
+		}
+	}
+	if len(fixed.Chirps) != 3 {
+		t.Errorf("%d chirps after repair, want 3", len(fixed.Chirps))
+	}
+	if fixed.Users[2].ID != 2 {
+		t.Errorf("user stored under 2 has ID %d after repair, want 2", fixed.Users[2].ID)
+	}
+	if fixed.Sequences[tableChirps] < 5 || fixed.Sequences[tableUsers] < 4 {
+		t.Errorf("sequences %v don't cover the IDs in use", fixed.Sequences)
+	}
+}
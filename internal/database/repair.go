@@ -0,0 +1,114 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// RepairReport lists the ID problems found in a JSON database file.
+type RepairReport struct {
+	Problems []string
+	Fixed    bool
+}
+
+// Repair checks the JSON database at path for ID collisions left behind by
+// the old len(map)+1 allocator: rows stored under a key that doesn't match
+// their ID, IDs the old allocator would hand out again, duplicate emails and
+// chirps whose author no longer resolves. With fix set, mismatched rows are
+// moved to fresh IDs and the sequences are advanced past every ID in use.
+// The server must not be running against path.
+func Repair(path string, fix bool) (RepairReport, error) {
+	report := RepairReport{}
+
+	dbStructure, err := loadSnapshot(path)
+	if err != nil {
+		return report, err
+	}
+	_, err = replayJournal(path+".journal", &dbStructure)
+	if err != nil {
+		return report, err
+	}
+
+	if dbStructure.Sequences[tableChirps] == 0 && len(dbStructure.Chirps) > 0 {
+		next := len(dbStructure.Chirps) + 1
+		if _, exists := dbStructure.Chirps[next]; exists {
+			report.addf("chirps: no sequence stored and the next ID %d is already taken", next)
+		}
+	}
+	if dbStructure.Sequences[tableUsers] == 0 && len(dbStructure.Users) > 0 {
+		next := len(dbStructure.Users) + 1
+		if _, exists := dbStructure.Users[next]; exists {
+			report.addf("users: no sequence stored and the next ID %d is already taken", next)
+		}
+	}
+
+	chirpKeys := []int{}
+	for key, chirp := range dbStructure.Chirps {
+		if key != chirp.ID {
+			chirpKeys = append(chirpKeys, key)
+		}
+		if _, exists := dbStructure.Users[chirp.AuthorID]; !exists {
+			report.addf("chirps: chirp %d belongs to missing user %d", key, chirp.AuthorID)
+		}
+	}
+	userKeys := []int{}
+	emails := map[string][]int{}
+	for key, user := range dbStructure.Users {
+		if key != user.ID {
+			userKeys = append(userKeys, key)
+		}
+		emails[user.Email] = append(emails[user.Email], key)
+	}
+	for email, ids := range emails {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			report.addf("users: email %s is used by users %v", email, ids)
+		}
+	}
+	sort.Ints(chirpKeys)
+	sort.Ints(userKeys)
+	for _, key := range chirpKeys {
+		report.addf("chirps: chirp stored under %d has ID %d", key, dbStructure.Chirps[key].ID)
+	}
+	for _, key := range userKeys {
+		report.addf("users: user stored under %d has ID %d", key, dbStructure.Users[key].ID)
+	}
+	sort.Strings(report.Problems)
+
+	if !fix {
+		return report, nil
+	}
+
+	dbStructure.seedSequences()
+	for _, key := range chirpKeys {
+		chirp := dbStructure.Chirps[key]
+		if _, taken := dbStructure.Chirps[chirp.ID]; taken {
+			chirp.ID = dbStructure.nextID(tableChirps)
+		}
+		delete(dbStructure.Chirps, key)
+		dbStructure.Chirps[chirp.ID] = chirp
+	}
+	for _, key := range userKeys {
+		user := dbStructure.Users[key]
+		// Chirps reference users by key, so keep the key and fix the ID.
+		user.ID = key
+		dbStructure.Users[key] = user
+	}
+
+	err = writeSnapshot(path, dbStructure)
+	if err != nil {
+		return report, err
+	}
+	err = os.Truncate(path+".journal", 0)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	report.Fixed = true
+	return report, nil
+}
+
+func (r *RepairReport) addf(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,1774 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SQLiteDriver is the database/sql driver name used by NewSQLiteDB. The
+// driver itself is registered by the main package when built with the
+// sqlite build tag.
+const SQLiteDriver = "sqlite"
+
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// migrations are applied in order; the index of a migration plus one is its
+// schema version. Never edit a migration that has shipped, append a new one.
+var migrations = []string{
+	`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		email         TEXT NOT NULL UNIQUE,
+		password      TEXT NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT NOT NULL,
+		author_id INTEGER NOT NULL REFERENCES users(id)
+	);
+	CREATE INDEX chirps_author_id ON chirps(author_id);
+	CREATE TABLE refresh_tokens (
+		token      TEXT PRIMARY KEY,
+		revoked_at TEXT
+	);
+	CREATE TABLE webhook_events (
+		id           TEXT PRIMARY KEY,
+		processed_at TEXT NOT NULL
+	);`,
+	`ALTER TABLE chirps ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chirps ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+	CREATE TABLE chirp_revisions (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id   INTEGER NOT NULL REFERENCES chirps(id),
+		body       TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions(chirp_id);`,
+	`ALTER TABLE chirps ADD COLUMN deleted_at TEXT;`,
+	`DROP TABLE refresh_tokens;
+	CREATE TABLE refresh_tokens (
+		hash       TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id),
+		family_id  TEXT NOT NULL,
+		device_id  TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		rotated_at TEXT,
+		revoked_at TEXT
+	);
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens(family_id);`,
+	`CREATE TABLE sessions (
+		id           TEXT PRIMARY KEY,
+		user_id      INTEGER NOT NULL REFERENCES users(id),
+		user_agent   TEXT NOT NULL DEFAULT '',
+		ip           TEXT NOT NULL DEFAULT '',
+		created_at   TEXT NOT NULL,
+		last_used_at TEXT NOT NULL,
+		expires_at   TEXT NOT NULL,
+		revoked_at   TEXT
+	);
+	CREATE INDEX sessions_user_id ON sessions(user_id);`,
+	`CREATE TABLE denied_tokens (
+		jti        TEXT PRIMARY KEY,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX denied_tokens_expires_at ON denied_tokens(expires_at);`,
+	`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE password_resets (
+		hash       TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id),
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		used_at    TEXT
+	);
+	CREATE INDEX password_resets_user_id ON password_resets(user_id);`,
+	`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN created_at TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	`ALTER TABLE chirps ADD COLUMN hidden_at TEXT;
+	ALTER TABLE chirps ADD COLUMN hidden_reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN suspended_at TEXT;
+	ALTER TABLE users ADD COLUMN suspended_reason TEXT NOT NULL DEFAULT '';
+	CREATE TABLE moderation_log (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		moderator_id INTEGER NOT NULL,
+		action       TEXT NOT NULL,
+		chirp_id     INTEGER NOT NULL DEFAULT 0,
+		user_id      INTEGER NOT NULL DEFAULT 0,
+		reason       TEXT NOT NULL,
+		created_at   TEXT NOT NULL
+	);
+	CREATE INDEX moderation_log_user_id ON moderation_log(user_id);
+	CREATE TRIGGER moderation_log_no_update BEFORE UPDATE ON moderation_log
+	BEGIN
+		SELECT RAISE(ABORT, 'moderation log is append-only');
+	END;
+	CREATE TRIGGER moderation_log_no_delete BEFORE DELETE ON moderation_log
+	BEGIN
+		SELECT RAISE(ABORT, 'moderation log is append-only');
+	END;`,
+	`CREATE TABLE reports (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id    INTEGER NOT NULL,
+		reporter_id INTEGER NOT NULL,
+		reason      TEXT NOT NULL,
+		details     TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL,
+		resolved_at TEXT,
+		resolver_id INTEGER NOT NULL DEFAULT 0,
+		resolution  TEXT NOT NULL DEFAULT '',
+		note        TEXT NOT NULL DEFAULT '',
+		UNIQUE (chirp_id, reporter_id)
+	);
+	CREATE INDEX reports_reporter_id ON reports(reporter_id);`,
+}
+
+func NewSQLiteDB(dsn string) (*SQLiteDB, error) {
+	// Foreign keys are off by default and the pragma is per connection, so
+	// it goes into the DSN, which the driver applies to every connection.
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open(SQLiteDriver, dsn+sep+"_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteDB{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteDB) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[i])
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const chirpColumns = `id, body, author_id, created_at, updated_at, deleted_at, hidden_at, hidden_reason`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	chirp := Chirp{}
+	err := row.Scan(
+		&chirp.ID, &chirp.Body, &chirp.AuthorID,
+		sqliteTime{&chirp.CreatedAt}, sqliteTime{&chirp.UpdatedAt}, sqliteTime{&chirp.DeletedAt},
+		sqliteTime{&chirp.HiddenAt}, &chirp.HiddenReason,
+	)
+	return chirp, err
+}
+
+func scanChirps(rows *sql.Rows) ([]Chirp, error) {
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+func (s *SQLiteDB) CreateChirp(body string, author_id int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	chirp, err := scanChirp(tx.QueryRow(
+		`INSERT INTO chirps (body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?)
+		RETURNING `+chirpColumns,
+		body, author_id, formatTime(now), formatTime(now),
+	))
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = addRevision(tx, chirp.ID, body, now)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, tx.Commit()
+}
+
+// visibleChirps is the condition for chirps everyone can see.
+const visibleChirps = `deleted_at IS NULL AND hidden_at IS NULL`
+
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	rows, err := s.db.Query(`SELECT ` + chirpColumns + ` FROM chirps WHERE ` + visibleChirps)
+	if err != nil {
+		return nil, err
+	}
+	return scanChirps(rows)
+}
+
+func (s *SQLiteDB) QueryChirps(query ChirpQuery) ([]Chirp, int, error) {
+	sqlQuery := `SELECT ` + chirpColumns + ` FROM chirps WHERE `
+	switch query.Status {
+	case ChirpsHidden:
+		sqlQuery += `hidden_at IS NOT NULL`
+	case ChirpsDeleted:
+		sqlQuery += `deleted_at IS NOT NULL`
+	case ChirpsAll:
+		sqlQuery += `1`
+	default:
+		sqlQuery += visibleChirps
+	}
+	args := []any{}
+	if query.AuthorID != 0 {
+		sqlQuery += ` AND author_id = ?`
+		args = append(args, query.AuthorID)
+	}
+	if query.Contains != "" {
+		sqlQuery += ` AND instr(lower(body), lower(?)) > 0`
+		args = append(args, query.Contains)
+	}
+	if query.After != 0 {
+		if query.Descending {
+			sqlQuery += ` AND id < ?`
+		} else {
+			sqlQuery += ` AND id > ?`
+		}
+		args = append(args, query.After)
+	}
+	if query.Descending {
+		sqlQuery += ` ORDER BY id DESC`
+	} else {
+		sqlQuery += ` ORDER BY id ASC`
+	}
+	if query.Limit > 0 {
+		// Fetch one extra row to learn whether there is a next page.
+		sqlQuery += ` LIMIT ?`
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	chirps, err := scanChirps(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next := 0
+	if query.Limit > 0 && len(chirps) > query.Limit {
+		chirps = chirps[:query.Limit]
+		next = chirps[len(chirps)-1].ID
+	}
+	return chirps, next, nil
+}
+
+func (s *SQLiteDB) GetChirpById(id int) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, errors.New("No Chirp")
+	}
+	return chirp, err
+}
+
+func (s *SQLiteDB) DeleteChirp(chirpid int) error {
+	res, err := s.db.Exec(
+		`UPDATE chirps SET deleted_at = COALESCE(deleted_at, ?) WHERE id = ?`,
+		formatTime(time.Now()), chirpid,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("No Chirp")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) RestoreChirp(chirpid int, deletedAfter time.Time) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, chirpid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if !chirp.IsDeleted() {
+		return Chirp{}, ErrNoChange
+	}
+	if chirp.DeletedAt.Before(deletedAfter) {
+		return Chirp{}, ErrRestoreExpired
+	}
+	_, err = tx.Exec(`UPDATE chirps SET deleted_at = NULL WHERE id = ?`, chirpid)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = time.Time{}
+	return chirp, tx.Commit()
+}
+
+func (s *SQLiteDB) PurgeChirps(cutoff time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`DELETE FROM chirp_revisions WHERE chirp_id IN (
+			SELECT id FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?
+		)`,
+		formatTime(cutoff),
+	)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`UPDATE reports SET resolved_at = ?, resolver_id = 0, resolution = ?, note = ?
+		WHERE resolved_at IS NULL AND chirp_id IN (
+			SELECT id FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?
+		)`,
+		formatTime(time.Now()), ResolutionDeleted, purgedNote, formatTime(cutoff),
+	)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(
+		`DELETE FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?`,
+		formatTime(cutoff),
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+func (s *SQLiteDB) UpdateChirp(id int, body string) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var revisions int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM chirp_revisions WHERE chirp_id = ?`, id).Scan(&revisions)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if revisions == 0 {
+		// Chirps created before revisions were stored.
+		_, err = tx.Exec(
+			`INSERT INTO chirp_revisions (chirp_id, body, created_at)
+			SELECT id, body, created_at FROM chirps WHERE id = ?`,
+			id,
+		)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	now := time.Now().UTC()
+	chirp, err := scanChirp(tx.QueryRow(
+		`UPDATE chirps SET body = ?, updated_at = ? WHERE id = ? RETURNING `+chirpColumns,
+		body, formatTime(now), id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, errors.New("No Chirp")
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = addRevision(tx, id, body, now)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, tx.Commit()
+}
+
+func (s *SQLiteDB) CountChirps(authorID int) (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM chirps WHERE author_id = ? AND `+visibleChirps,
+		authorID,
+	).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteDB) GetChirpRevisions(chirpID int) ([]ChirpRevision, error) {
+	chirp, err := s.GetChirpById(chirpID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT id, chirp_id, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id`,
+		chirpID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ChirpRevision{}
+	for rows.Next() {
+		revision := ChirpRevision{}
+		err = rows.Scan(&revision.ID, &revision.ChirpID, &revision.Body, sqliteTime{&revision.CreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		revisions = append(revisions, ChirpRevision{ChirpID: chirpID, Body: chirp.Body, CreatedAt: chirp.CreatedAt})
+	}
+	return revisions, nil
+}
+
+func addRevision(tx *sql.Tx, chirpID int, body string, createdAt time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO chirp_revisions (chirp_id, body, created_at) VALUES (?, ?, ?)`,
+		chirpID, body, formatTime(createdAt),
+	)
+	return err
+}
+
+func (s *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	hashed_password, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, email).Scan(&exists)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrEmailTaken
+	}
+
+	createdAt := time.Now().UTC()
+	res, err := tx.Exec(
+		`INSERT INTO users (email, password, created_at) VALUES (?, ?, ?)`,
+		email, string(hashed_password), formatTime(createdAt),
+	)
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		ID:        int(id),
+		Email:     email,
+		Password:  string(hashed_password),
+		CreatedAt: createdAt,
+		Role:      RoleUser,
+	}, nil
+}
+
+const userColumns = `id, email, password, is_chirpy_red, email_verified,
+	display_name, bio, avatar_url, created_at, role, suspended_at, suspended_reason`
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	err := row.Scan(
+		&user.ID, &user.Email, &user.Password, &user.IsChirpyRed, &user.EmailVerified,
+		&user.DisplayName, &user.Bio, &user.AvatarURL, sqliteTime{&user.CreatedAt}, &user.Role,
+		sqliteTime{&user.SuspendedAt}, &user.SuspendedReason,
+	)
+	return user, err
+}
+
+func (s *SQLiteDB) getUserByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+}
+
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	user, err := s.getUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("User not found")
+	}
+	return user, err
+}
+
+func (s *SQLiteDB) GetUser(id int) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *SQLiteDB) AuthorizeUser(email, password string) (User, error) {
+	user, err := s.getUserByEmail(email)
+	found := true
+	if errors.Is(err, sql.ErrNoRows) {
+		found = false
+	} else if err != nil {
+		return User{}, err
+	}
+
+	err = checkPassword(user, found, password)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteDB) UpdateUser(id int, update UserUpdate) (User, error) {
+	hashed_password := ""
+	if update.Password != nil {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+		hashed_password = string(hashed)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("User not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	emailChanged := update.Email != nil && *update.Email != user.Email
+	credentialsChanged := emailChanged || update.Password != nil
+	if credentialsChanged {
+		err = checkPassword(user, true, update.CurrentPassword)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	if emailChanged {
+		var exists bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, *update.Email).Scan(&exists)
+		if err != nil {
+			return User{}, err
+		}
+		if exists {
+			return User{}, ErrEmailTaken
+		}
+		user.Email = *update.Email
+		user.EmailVerified = false
+	}
+	if update.Password != nil {
+		user.Password = hashed_password
+	}
+
+	update.applyProfile(&user)
+
+	_, err = tx.Exec(
+		`UPDATE users SET email = ?, password = ?, email_verified = ?,
+			display_name = ?, bio = ?, avatar_url = ? WHERE id = ?`,
+		user.Email, user.Password, user.EmailVerified,
+		user.DisplayName, user.Bio, user.AvatarURL, id,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	if credentialsChanged {
+		_, err = revokeUserSessionsTx(tx, id, update.KeepSession, time.Now().UTC())
+		if err != nil {
+			return User{}, err
+		}
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) DeleteUser(id int, password string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("User not found")
+	}
+	if err != nil {
+		return err
+	}
+	err = checkPassword(user, true, password)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		`DELETE FROM reports WHERE reporter_id = ?1 OR chirp_id IN (SELECT id FROM chirps WHERE author_id = ?1)`,
+		`DELETE FROM chirp_revisions WHERE chirp_id IN (SELECT id FROM chirps WHERE author_id = ?)`,
+		`DELETE FROM chirps WHERE author_id = ?`,
+		`DELETE FROM refresh_tokens WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM password_resets WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) ExportUser(id int) (UserData, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserData{}, err
+	}
+	defer tx.Rollback()
+
+	data := UserData{
+		ChirpRevisions: []ChirpRevision{},
+		Sessions:       []Session{},
+		RefreshTokens:  []RefreshToken{},
+		PasswordResets: []PasswordReset{},
+		Reports:        []Report{},
+		ModerationLog:  []ModerationEntry{},
+	}
+	data.User, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserData{}, errors.New("User not found")
+	}
+	if err != nil {
+		return UserData{}, err
+	}
+
+	rows, err := tx.Query(`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? ORDER BY id`, id)
+	if err != nil {
+		return UserData{}, err
+	}
+	data.Chirps, err = scanChirps(rows)
+	if err != nil {
+		return UserData{}, err
+	}
+
+	err = queryEach(tx,
+		`SELECT id, chirp_id, body, created_at FROM chirp_revisions
+		WHERE chirp_id IN (SELECT id FROM chirps WHERE author_id = ?) ORDER BY id`,
+		id, func(row rowScanner) error {
+			revision := ChirpRevision{}
+			err := row.Scan(&revision.ID, &revision.ChirpID, &revision.Body, sqliteTime{&revision.CreatedAt})
+			if err != nil {
+				return err
+			}
+			data.ChirpRevisions = append(data.ChirpRevisions, revision)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	err = queryEach(tx,
+		`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? ORDER BY created_at`,
+		id, func(row rowScanner) error {
+			session, err := scanSession(row)
+			if err != nil {
+				return err
+			}
+			data.Sessions = append(data.Sessions, session)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	err = queryEach(tx,
+		`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = ? ORDER BY created_at`,
+		id, func(row rowScanner) error {
+			token, err := scanRefreshToken(row)
+			if err != nil {
+				return err
+			}
+			data.RefreshTokens = append(data.RefreshTokens, token)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	err = queryEach(tx,
+		`SELECT hash, user_id, created_at, expires_at, used_at FROM password_resets WHERE user_id = ? ORDER BY created_at`,
+		id, func(row rowScanner) error {
+			reset := PasswordReset{}
+			err := row.Scan(
+				&reset.Hash, &reset.UserID, sqliteTime{&reset.CreatedAt},
+				sqliteTime{&reset.ExpiresAt}, sqliteTime{&reset.UsedAt},
+			)
+			if err != nil {
+				return err
+			}
+			data.PasswordResets = append(data.PasswordResets, reset)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	err = queryEach(tx,
+		`SELECT `+reportColumns+` FROM reports WHERE reporter_id = ? ORDER BY id`,
+		id, func(row rowScanner) error {
+			report, err := scanReport(row)
+			if err != nil {
+				return err
+			}
+			data.Reports = append(data.Reports, report)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	err = queryEach(tx,
+		`SELECT `+moderationColumns+` FROM moderation_log WHERE user_id = ? ORDER BY id`,
+		id, func(row rowScanner) error {
+			entry, err := scanModerationEntry(row)
+			if err != nil {
+				return err
+			}
+			data.ModerationLog = append(data.ModerationLog, entry)
+			return nil
+		})
+	if err != nil {
+		return UserData{}, err
+	}
+	return data, nil
+}
+
+// queryEach runs a query with a single argument and calls scan for every
+// row.
+func queryEach(tx *sql.Tx, query string, arg any, scan func(rowScanner) error) error {
+	rows, err := tx.Query(query, arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteDB) VerifyEmail(userID int, email string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("User not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if user.Email != email {
+		return User{}, ErrEmailChanged
+	}
+	_, err = tx.Exec(`UPDATE users SET email_verified = 1 WHERE id = ?`, userID)
+	if err != nil {
+		return User{}, err
+	}
+	user.EmailVerified = true
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) SetUserRole(id int, role Role) (User, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`UPDATE users SET role = ? WHERE id = ? RETURNING `+userColumns,
+		role, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("User doesn't exist")
+	}
+	return user, err
+}
+
+func (s *SQLiteDB) CountUsers(role Role) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, role).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteDB) ModerateChirp(entry ModerationEntry) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := moderateChirpTx(tx, entry, time.Now().UTC())
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+func moderateChirpTx(tx *sql.Tx, entry ModerationEntry, now time.Time) (Chirp, error) {
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, entry.ChirpID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	switch entry.Action {
+	case ActionHideChirp:
+		if chirp.IsHidden() {
+			return Chirp{}, ErrNoChange
+		}
+		chirp.HiddenAt = now
+		chirp.HiddenReason = entry.Reason
+		_, err = tx.Exec(
+			`UPDATE chirps SET hidden_at = ?, hidden_reason = ? WHERE id = ?`,
+			formatTime(now), entry.Reason, chirp.ID,
+		)
+	case ActionUnhideChirp:
+		if !chirp.IsHidden() {
+			return Chirp{}, ErrNoChange
+		}
+		chirp.HiddenAt = time.Time{}
+		chirp.HiddenReason = ""
+		_, err = tx.Exec(`UPDATE chirps SET hidden_at = NULL, hidden_reason = '' WHERE id = ?`, chirp.ID)
+	case ActionDeleteChirp:
+		_, err = tx.Exec(`DELETE FROM chirp_revisions WHERE chirp_id = ?`, chirp.ID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, chirp.ID)
+		}
+		if err == nil {
+			_, err = resolveReportsTx(tx, chirp.ID, entry.ModeratorID, ResolutionDeleted, entry.Reason, now)
+		}
+	default:
+		return Chirp{}, fmt.Errorf("%q is not a chirp action", entry.Action)
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	entry.UserID = chirp.AuthorID
+	entry.CreatedAt = now
+	err = logModerationTx(tx, entry)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s *SQLiteDB) ModerateUser(entry ModerationEntry) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, entry.UserID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	now := time.Now().UTC()
+	switch entry.Action {
+	case ActionSuspendUser:
+		if user.IsSuspended() {
+			return User{}, ErrNoChange
+		}
+		user.SuspendedAt = now
+		user.SuspendedReason = entry.Reason
+		_, err = tx.Exec(
+			`UPDATE users SET suspended_at = ?, suspended_reason = ? WHERE id = ?`,
+			formatTime(now), entry.Reason, user.ID,
+		)
+		if err == nil {
+			_, err = revokeUserSessionsTx(tx, user.ID, "", now)
+		}
+	case ActionUnsuspendUser:
+		if !user.IsSuspended() {
+			return User{}, ErrNoChange
+		}
+		user.SuspendedAt = time.Time{}
+		user.SuspendedReason = ""
+		_, err = tx.Exec(`UPDATE users SET suspended_at = NULL, suspended_reason = '' WHERE id = ?`, user.ID)
+	default:
+		return User{}, fmt.Errorf("%q is not a user action", entry.Action)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	entry.ChirpID = 0
+	entry.CreatedAt = now
+	err = logModerationTx(tx, entry)
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func logModerationTx(tx *sql.Tx, entry ModerationEntry) error {
+	_, err := tx.Exec(
+		`INSERT INTO moderation_log (moderator_id, action, chirp_id, user_id, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.ModeratorID, entry.Action, entry.ChirpID, entry.UserID, entry.Reason, formatTime(entry.CreatedAt),
+	)
+	return err
+}
+
+const moderationColumns = `id, moderator_id, action, chirp_id, user_id, reason, created_at`
+
+func scanModerationEntry(row rowScanner) (ModerationEntry, error) {
+	entry := ModerationEntry{}
+	err := row.Scan(
+		&entry.ID, &entry.ModeratorID, &entry.Action, &entry.ChirpID, &entry.UserID,
+		&entry.Reason, sqliteTime{&entry.CreatedAt},
+	)
+	return entry, err
+}
+
+func (s *SQLiteDB) GetModerationLog(query ModerationLogQuery) ([]ModerationEntry, int, error) {
+	sqlQuery := `SELECT ` + moderationColumns + ` FROM moderation_log WHERE 1`
+	args := []any{}
+	if query.ModeratorID != 0 {
+		sqlQuery += ` AND moderator_id = ?`
+		args = append(args, query.ModeratorID)
+	}
+	if query.UserID != 0 {
+		sqlQuery += ` AND user_id = ?`
+		args = append(args, query.UserID)
+	}
+	if query.ChirpID != 0 {
+		sqlQuery += ` AND chirp_id = ?`
+		args = append(args, query.ChirpID)
+	}
+	if query.Action != "" {
+		sqlQuery += ` AND action = ?`
+		args = append(args, query.Action)
+	}
+	if query.Before != 0 {
+		sqlQuery += ` AND id < ?`
+		args = append(args, query.Before)
+	}
+	sqlQuery += ` ORDER BY id DESC`
+	if query.Limit > 0 {
+		// Fetch one extra row to learn whether there is a next page.
+		sqlQuery += ` LIMIT ?`
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []ModerationEntry{}
+	for rows.Next() {
+		entry, err := scanModerationEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next := 0
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		next = entries[len(entries)-1].ID
+	}
+	return entries, next, nil
+}
+
+const reportColumns = `id, chirp_id, reporter_id, reason, details, created_at,
+	resolved_at, resolver_id, resolution, note`
+
+func scanReport(row rowScanner) (Report, error) {
+	report := Report{}
+	err := row.Scan(
+		&report.ID, &report.ChirpID, &report.ReporterID, &report.Reason, &report.Details,
+		sqliteTime{&report.CreatedAt}, sqliteTime{&report.ResolvedAt},
+		&report.ResolverID, &report.Resolution, &report.Note,
+	)
+	return report, err
+}
+
+func (s *SQLiteDB) CreateReport(report Report, hideAfter int) (Report, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, false, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, report.ChirpID))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !chirp.IsVisible()) {
+		return Report{}, false, errors.New("No Chirp")
+	}
+	if err != nil {
+		return Report{}, false, err
+	}
+
+	// The unique constraint decides between concurrent duplicate reports.
+	now := time.Now().UTC()
+	report.CreatedAt = now
+	res, err := tx.Exec(
+		`INSERT INTO reports (chirp_id, reporter_id, reason, details, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (chirp_id, reporter_id) DO NOTHING`,
+		report.ChirpID, report.ReporterID, report.Reason, report.Details, formatTime(now),
+	)
+	if err != nil {
+		return Report{}, false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return Report{}, false, err
+	}
+	if inserted == 0 {
+		return Report{}, false, ErrAlreadyReported
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Report{}, false, err
+	}
+	report.ID = int(id)
+
+	hidden := false
+	if hideAfter > 0 {
+		var open int
+		err = tx.QueryRow(
+			`SELECT COUNT(*) FROM reports WHERE chirp_id = ? AND resolved_at IS NULL`,
+			report.ChirpID,
+		).Scan(&open)
+		if err != nil {
+			return Report{}, false, err
+		}
+		if open >= hideAfter {
+			_, err = moderateChirpTx(tx, autoHideEntry(chirp.ID, open), now)
+			if err != nil {
+				return Report{}, false, err
+			}
+			hidden = true
+		}
+	}
+	return report, hidden, tx.Commit()
+}
+
+func (s *SQLiteDB) GetReports(query ReportQuery) ([]Report, int, error) {
+	sqlQuery := `SELECT ` + reportColumns + ` FROM reports WHERE `
+	switch query.Status {
+	case ReportsResolved:
+		sqlQuery += `resolved_at IS NOT NULL`
+	case ReportsAll:
+		sqlQuery += `1`
+	default:
+		sqlQuery += `resolved_at IS NULL`
+	}
+	args := []any{}
+	if query.ChirpID != 0 {
+		sqlQuery += ` AND chirp_id = ?`
+		args = append(args, query.ChirpID)
+	}
+	if query.Reason != "" {
+		sqlQuery += ` AND reason = ?`
+		args = append(args, query.Reason)
+	}
+	if query.After != 0 {
+		sqlQuery += ` AND id > ?`
+		args = append(args, query.After)
+	}
+	sqlQuery += ` ORDER BY id ASC`
+	if query.Limit > 0 {
+		// Fetch one extra row to learn whether there is a next page.
+		sqlQuery += ` LIMIT ?`
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		reports = append(reports, report)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next := 0
+	if query.Limit > 0 && len(reports) > query.Limit {
+		reports = reports[:query.Limit]
+		next = reports[len(reports)-1].ID
+	}
+	return reports, next, nil
+}
+
+func (s *SQLiteDB) ResolveReports(chirpID, resolverID int, resolution Resolution, note string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	resolved, err := resolveReportsTx(tx, chirpID, resolverID, resolution, note, now)
+	if err != nil {
+		return 0, err
+	}
+	if resolved == 0 {
+		return 0, ErrNoChange
+	}
+	// A chirp that is already gone needs no further action.
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, chirpID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return resolved, tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if resolution == ResolutionDismissed {
+		auto, err := autoHiddenTx(tx, chirp)
+		if err != nil {
+			return 0, err
+		}
+		if !auto {
+			return resolved, tx.Commit()
+		}
+	}
+	entry := resolution.entry(chirpID, resolverID, note)
+	if resolution == ResolutionHidden && chirp.IsHidden() {
+		err = confirmHideTx(tx, chirp, entry, now)
+		if err != nil {
+			return 0, err
+		}
+		return resolved, tx.Commit()
+	}
+	_, err = moderateChirpTx(tx, entry, now)
+	if err != nil && !errors.Is(err, ErrNoChange) {
+		return 0, err
+	}
+	return resolved, tx.Commit()
+}
+
+// confirmHideTx records a moderator's hide of a chirp that is already
+// hidden, typically by reports, and takes over its reason. The chirp then
+// counts as hidden by the moderator, so dismissing later reports won't
+// unhide it.
+func confirmHideTx(tx *sql.Tx, chirp Chirp, entry ModerationEntry, now time.Time) error {
+	_, err := tx.Exec(`UPDATE chirps SET hidden_reason = ? WHERE id = ?`, entry.Reason, chirp.ID)
+	if err != nil {
+		return err
+	}
+	entry.UserID = chirp.AuthorID
+	entry.CreatedAt = now
+	return logModerationTx(tx, entry)
+}
+
+// autoHiddenTx reports whether chirp is hidden because of reports rather
+// than by a moderator: its latest hide has no moderator.
+func autoHiddenTx(tx *sql.Tx, chirp Chirp) (bool, error) {
+	if !chirp.IsHidden() {
+		return false, nil
+	}
+	var moderatorID int
+	err := tx.QueryRow(
+		`SELECT moderator_id FROM moderation_log WHERE chirp_id = ? AND action = ?
+		ORDER BY id DESC LIMIT 1`,
+		chirp.ID, ActionHideChirp,
+	).Scan(&moderatorID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return moderatorID == 0, nil
+}
+
+func resolveReportsTx(tx *sql.Tx, chirpID, resolverID int, resolution Resolution, note string, now time.Time) (int, error) {
+	res, err := tx.Exec(
+		`UPDATE reports SET resolved_at = ?, resolver_id = ?, resolution = ?, note = ?
+		WHERE chirp_id = ? AND resolved_at IS NULL`,
+		formatTime(now), resolverID, resolution, note, chirpID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+const refreshTokenColumns = `hash, user_id, family_id, device_id, created_at, expires_at, rotated_at, revoked_at`
+
+func scanRefreshToken(row rowScanner) (RefreshToken, error) {
+	token := RefreshToken{}
+	err := row.Scan(
+		&token.Hash, &token.UserID, &token.FamilyID, &token.DeviceID,
+		sqliteTime{&token.CreatedAt}, sqliteTime{&token.ExpiresAt},
+		sqliteTime{&token.RotatedAt}, sqliteTime{&token.RevokedAt},
+	)
+	return token, err
+}
+
+func insertRefreshToken(tx *sql.Tx, token RefreshToken) error {
+	_, err := tx.Exec(
+		`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, NULL, NULL)`,
+		token.Hash, token.UserID, token.FamilyID, token.DeviceID,
+		formatTime(token.CreatedAt), formatTime(token.ExpiresAt),
+	)
+	return err
+}
+
+func revokeFamilyTx(tx *sql.Tx, familyID string, now time.Time) error {
+	_, err := tx.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`,
+		formatTime(now), familyID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		formatTime(now), familyID,
+	)
+	return err
+}
+
+func (s *SQLiteDB) CreateSession(session Session, token RefreshToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, NULL)`,
+		session.ID, session.UserID, session.UserAgent, session.IP,
+		formatTime(session.CreatedAt), formatTime(session.LastUsedAt), formatTime(session.ExpiresAt),
+	)
+	if err != nil {
+		return err
+	}
+	token.UserID = session.UserID
+	token.FamilyID = session.ID
+	err = insertRefreshToken(tx, token)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RotateRefreshToken(hash string, next RefreshToken) (RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanRefreshToken(tx.QueryRow(
+		`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE hash = ?`, hash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	err = checkRotation(current, next)
+	if errors.Is(err, ErrTokenReused) {
+		err = revokeFamilyTx(tx, current.FamilyID, next.CreatedAt)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrTokenReused
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE hash = ?`, formatTime(next.CreatedAt), hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	next.UserID = current.UserID
+	next.FamilyID = current.FamilyID
+	err = insertRefreshToken(tx, next)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	_, err = tx.Exec(
+		`UPDATE sessions SET last_used_at = ?, expires_at = ? WHERE id = ?`,
+		formatTime(next.CreatedAt), formatTime(next.ExpiresAt), next.FamilyID,
+	)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return next, tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeRefreshToken(hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var familyID string
+	err = tx.QueryRow(`SELECT family_id FROM refresh_tokens WHERE hash = ?`, hash).Scan(&familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = revokeFamilyTx(tx, familyID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const sessionColumns = `id, user_id, user_agent, ip, created_at, last_used_at, expires_at, revoked_at`
+
+func scanSession(row rowScanner) (Session, error) {
+	session := Session{}
+	err := row.Scan(
+		&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		sqliteTime{&session.CreatedAt}, sqliteTime{&session.LastUsedAt},
+		sqliteTime{&session.ExpiresAt}, sqliteTime{&session.RevokedAt},
+	)
+	return session, err
+}
+
+func (s *SQLiteDB) GetSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC`,
+		userID, formatTime(time.Now()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLiteDB) GetSession(userID int, id string) (Session, error) {
+	row := s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (s *SQLiteDB) RevokeSession(userID int, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)`, id, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrSessionNotFound
+	}
+	err = revokeFamilyTx(tx, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeAllSessions(userID int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	active, err := revokeUserSessionsTx(tx, userID, "", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return active, tx.Commit()
+}
+
+func revokeUserSessionsTx(tx *sql.Tx, userID int, keep string, now time.Time) (int, error) {
+	var active int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM sessions WHERE user_id = ? AND id != ? AND revoked_at IS NULL AND expires_at > ?`,
+		userID, keep, formatTime(now),
+	).Scan(&active)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL`,
+		formatTime(now), userID, keep,
+	)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND family_id != ? AND revoked_at IS NULL`,
+		formatTime(now), userID, keep,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return active, nil
+}
+
+func (s *SQLiteDB) CreatePasswordReset(reset PasswordReset) error {
+	_, err := s.db.Exec(
+		`INSERT INTO password_resets (hash, user_id, created_at, expires_at, used_at) VALUES (?, ?, ?, ?, NULL)`,
+		reset.Hash, reset.UserID, formatTime(reset.CreatedAt), formatTime(reset.ExpiresAt),
+	)
+	return err
+}
+
+func (s *SQLiteDB) ResetPassword(hash, password string) (User, error) {
+	hashed_password, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var userID int
+	err = tx.QueryRow(
+		`SELECT user_id FROM password_resets WHERE hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hash, formatTime(now),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := scanUser(tx.QueryRow(
+		`UPDATE users SET password = ? WHERE id = ? RETURNING `+userColumns,
+		string(hashed_password), userID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec(
+		`UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL`,
+		formatTime(now), userID,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	_, err = revokeUserSessionsTx(tx, userID, "", now)
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLiteDB) DenyToken(jti string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM denied_tokens WHERE expires_at < ?`, formatTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO denied_tokens (jti, expires_at) VALUES (?, ?)`,
+		jti, formatTime(expiresAt),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) IsTokenDenied(jti string) (bool, error) {
+	var denied bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM denied_tokens WHERE jti = ?)`, jti).Scan(&denied)
+	return denied, err
+}
+
+func (s *SQLiteDB) ConsumeToken(jti string, expiresAt time.Time) error {
+	result, err := s.db.Exec(
+		`INSERT INTO denied_tokens (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING`,
+		jti, formatTime(expiresAt),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+func (s *SQLiteDB) PruneTokens(now, revokedBefore time.Time) (PruneStats, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PruneStats{}, err
+	}
+	defer tx.Rollback()
+
+	stats := PruneStats{}
+	stats.RefreshTokens, err = deleteCount(tx,
+		`DELETE FROM refresh_tokens WHERE expires_at < ? OR revoked_at < ?`,
+		formatTime(now), formatTime(revokedBefore),
+	)
+	if err != nil {
+		return PruneStats{}, err
+	}
+	stats.Sessions, err = deleteCount(tx,
+		`DELETE FROM sessions WHERE expires_at < ? OR revoked_at < ?`,
+		formatTime(now), formatTime(revokedBefore),
+	)
+	if err != nil {
+		return PruneStats{}, err
+	}
+	stats.DeniedTokens, err = deleteCount(tx, `DELETE FROM denied_tokens WHERE expires_at < ?`, formatTime(now))
+	if err != nil {
+		return PruneStats{}, err
+	}
+	stats.PasswordResets, err = deleteCount(tx,
+		`DELETE FROM password_resets WHERE expires_at < ? OR used_at < ?`,
+		formatTime(now), formatTime(revokedBefore),
+	)
+	if err != nil {
+		return PruneStats{}, err
+	}
+	return stats, tx.Commit()
+}
+
+func deleteCount(tx *sql.Tx, query string, args ...any) (int, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLiteDB) ProcessChirpyRedEvent(eventID string, userID int, isChirpyRed bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if eventID != "" {
+		res, err := tx.Exec(
+			`INSERT INTO webhook_events (id, processed_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`,
+			eventID, formatTime(time.Now()),
+		)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrEventProcessed
+		}
+	}
+
+	res, err := tx.Exec(`UPDATE users SET is_chirpy_red = ? WHERE id = ?`, isChirpyRed, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+// sqliteTimeFormat is a fixed-width UTC layout, so stored timestamps sort
+// and compare correctly as text regardless of the driver's time handling.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteTime scans a timestamp written by formatTime. Empty strings and
+// NULLs, used for rows that predate a column, scan as the zero time.
+type sqliteTime struct {
+	t *time.Time
+}
+
+func (st sqliteTime) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*st.t = time.Time{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case time.Time:
+		*st.t = v.UTC()
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
+	}
+	if s == "" {
+		*st.t = time.Time{}
+		return nil
+	}
+	t, err := time.Parse(sqliteTimeFormat, s)
+	if err != nil {
+		return err
+	}
+	*st.t = t
+	return nil
+}
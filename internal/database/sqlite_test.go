@@ -0,0 +1,20 @@
+//go:build sqlite
+
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) Store {
+		db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Store is the persistence interface the API handlers depend on. DB keeps
+// everything in a single JSON file; SQLiteDB stores it in a SQLite database.
+type Store interface {
+	CreateChirp(body string, author_id int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	QueryChirps(query ChirpQuery) ([]Chirp, int, error)
+	GetChirpById(id int) (Chirp, error)
+	DeleteChirp(chirpid int) error
+	RestoreChirp(chirpid int, deletedAfter time.Time) (Chirp, error)
+	PurgeChirps(cutoff time.Time) (int, error)
+	UpdateChirp(id int, body string) (Chirp, error)
+	GetChirpRevisions(chirpID int) ([]ChirpRevision, error)
+	CountChirps(authorID int) (int, error)
+	ModerateChirp(entry ModerationEntry) (Chirp, error)
+	CreateReport(report Report, hideAfter int) (Report, bool, error)
+	GetReports(query ReportQuery) ([]Report, int, error)
+	ResolveReports(chirpID, resolverID int, resolution Resolution, note string) (int, error)
+
+	CreateUser(email string, password string) (User, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	AuthorizeUser(email, password string) (User, error)
+	UpdateUser(id int, update UserUpdate) (User, error)
+	VerifyEmail(userID int, email string) (User, error)
+	DeleteUser(id int, password string) error
+	ExportUser(id int) (UserData, error)
+	CreatePasswordReset(reset PasswordReset) error
+	ResetPassword(hash, password string) (User, error)
+	SetUserRole(id int, role Role) (User, error)
+	CountUsers(role Role) (int, error)
+	ModerateUser(entry ModerationEntry) (User, error)
+	GetModerationLog(query ModerationLogQuery) ([]ModerationEntry, int, error)
+
+	CreateSession(session Session, token RefreshToken) error
+	RotateRefreshToken(hash string, next RefreshToken) (RefreshToken, error)
+	RevokeRefreshToken(hash string) error
+	GetSessions(userID int) ([]Session, error)
+	GetSession(userID int, id string) (Session, error)
+	RevokeSession(userID int, id string) error
+	RevokeAllSessions(userID int) (int, error)
+
+	DenyToken(jti string, expiresAt time.Time) error
+	IsTokenDenied(jti string) (bool, error)
+	ConsumeToken(jti string, expiresAt time.Time) error
+	PruneTokens(now, revokedBefore time.Time) (PruneStats, error)
+
+	ProcessChirpyRedEvent(eventID string, userID int, isChirpyRed bool) error
+
+	Close() error
+}
+
+// Role decides what a user may do. Each role can do everything the roles
+// before it can: user, moderator, admin.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("Unknown role %q.", s)
+	}
+	return role, nil
+}
+
+// AtLeast reports whether r has every permission of min. Unknown roles
+// have none beyond those of a user.
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+// ChirpQuery selects a page of chirps. Zero values mean no filter, ascending
+// order, start from the beginning and no limit.
+type ChirpQuery struct {
+	AuthorID int
+	Status   ChirpStatus
+	// Contains matches chirps whose body contains the text, ignoring case.
+	Contains   string
+	Descending bool
+	// After is a cursor: only chirps that sort after the chirp with this ID
+	// are returned.
+	After int
+	Limit int
+}
+
+// ChirpStatus selects chirps by their moderation state. The zero value
+// selects the chirps everyone can see: neither deleted nor hidden.
+type ChirpStatus string
+
+const (
+	ChirpsVisible ChirpStatus = ""
+	ChirpsHidden  ChirpStatus = "hidden"
+	ChirpsDeleted ChirpStatus = "deleted"
+	ChirpsAll     ChirpStatus = "all"
+)
+
+// ModerationAction is what a moderator did, as recorded in the log.
+type ModerationAction string
+
+const (
+	ActionHideChirp     ModerationAction = "hide_chirp"
+	ActionUnhideChirp   ModerationAction = "unhide_chirp"
+	ActionDeleteChirp   ModerationAction = "delete_chirp"
+	ActionSuspendUser   ModerationAction = "suspend_user"
+	ActionUnsuspendUser ModerationAction = "unsuspend_user"
+)
+
+// ModerationLogQuery selects a page of the moderation log, newest first.
+// Zero values mean no filter, start from the newest entry and no limit.
+type ModerationLogQuery struct {
+	ModeratorID int
+	UserID      int
+	ChirpID     int
+	Action      ModerationAction
+	// Before is a cursor: only entries older than the entry with this ID
+	// are returned.
+	Before int
+	Limit  int
+}
+
+func (query ModerationLogQuery) matches(entry ModerationEntry) bool {
+	return (query.ModeratorID == 0 || entry.ModeratorID == query.ModeratorID) &&
+		(query.UserID == 0 || entry.UserID == query.UserID) &&
+		(query.ChirpID == 0 || entry.ChirpID == query.ChirpID) &&
+		(query.Action == "" || entry.Action == query.Action) &&
+		(query.Before == 0 || entry.ID < query.Before)
+}
+
+// ReportReason is the category a reporter picks for a report.
+type ReportReason string
+
+const (
+	ReasonSpam           ReportReason = "spam"
+	ReasonHarassment     ReportReason = "harassment"
+	ReasonHate           ReportReason = "hate"
+	ReasonViolence       ReportReason = "violence"
+	ReasonSexual         ReportReason = "sexual"
+	ReasonMisinformation ReportReason = "misinformation"
+	ReasonOther          ReportReason = "other"
+)
+
+// ReportReasons lists every valid ReportReason.
+var ReportReasons = []ReportReason{
+	ReasonSpam, ReasonHarassment, ReasonHate, ReasonViolence,
+	ReasonSexual, ReasonMisinformation, ReasonOther,
+}
+
+// ParseReportReason returns the report reason named s.
+func ParseReportReason(s string) (ReportReason, error) {
+	for _, reason := range ReportReasons {
+		if string(reason) == s {
+			return reason, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown reason %q.", s)
+}
+
+// Resolution is how a moderator closed a report.
+type Resolution string
+
+const (
+	ResolutionDismissed Resolution = "dismissed"
+	ResolutionHidden    Resolution = "hidden"
+	ResolutionDeleted   Resolution = "deleted"
+)
+
+// entry is the moderation log entry for the action a resolution takes on
+// the chirp. Dismissing unhides a chirp the reports hid automatically.
+func (r Resolution) entry(chirpID, resolverID int, note string) ModerationEntry {
+	action := ActionHideChirp
+	switch r {
+	case ResolutionDeleted:
+		action = ActionDeleteChirp
+	case ResolutionDismissed:
+		action = ActionUnhideChirp
+		if note == "" {
+			note = "Reports dismissed."
+		}
+	}
+	return ModerationEntry{ModeratorID: resolverID, Action: action, ChirpID: chirpID, Reason: note}
+}
+
+// purgedNote is the note on reports closed because the author deleted the
+// chirp and it was purged.
+const purgedNote = "The author deleted the chirp."
+
+// autoHideEntry is the moderation log entry for a chirp hidden because of
+// the number of reports. It has no moderator.
+func autoHideEntry(chirpID, reports int) ModerationEntry {
+	return ModerationEntry{
+		Action:  ActionHideChirp,
+		ChirpID: chirpID,
+		Reason:  fmt.Sprintf("Hidden automatically after %d reports.", reports),
+	}
+}
+
+// ReportStatus selects reports by whether they are resolved. The zero value
+// selects open reports.
+type ReportStatus string
+
+const (
+	ReportsOpen     ReportStatus = ""
+	ReportsResolved ReportStatus = "resolved"
+	ReportsAll      ReportStatus = "all"
+)
+
+// ReportQuery selects a page of reports, oldest first. Zero values mean
+// open reports, no other filter, start from the oldest and no limit.
+type ReportQuery struct {
+	ChirpID int
+	Reason  ReportReason
+	Status  ReportStatus
+	// After is a cursor: only reports newer than the report with this ID
+	// are returned.
+	After int
+	Limit int
+}
+
+func (query ReportQuery) matches(report Report) bool {
+	switch query.Status {
+	case ReportsOpen:
+		if report.IsResolved() {
+			return false
+		}
+	case ReportsResolved:
+		if !report.IsResolved() {
+			return false
+		}
+	}
+	return (query.ChirpID == 0 || report.ChirpID == query.ChirpID) &&
+		(query.Reason == "" || report.Reason == query.Reason) &&
+		(query.After == 0 || report.ID > query.After)
+}
+
+// PruneStats counts the records removed by PruneTokens.
+type PruneStats struct {
+	RefreshTokens  int
+	Sessions       int
+	DeniedTokens   int
+	PasswordResets int
+}
+
+// UserData is everything stored about a user, for data exports. Chirps
+// include deleted ones that haven't been purged yet.
+type UserData struct {
+	User           User
+	Chirps         []Chirp
+	ChirpRevisions []ChirpRevision
+	Sessions       []Session
+	RefreshTokens  []RefreshToken
+	PasswordResets []PasswordReset
+	// Reports are the reports the user filed.
+	Reports []Report
+	// ModerationLog holds the entries about the user or their chirps.
+	ModerationLog []ModerationEntry
+}
+
+// UserUpdate lists the changes to a user; nil fields are left unchanged.
+type UserUpdate struct {
+	Email       *string
+	Password    *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+	// CurrentPassword must match when Email or Password change.
+	CurrentPassword string
+	// KeepSession is the session that stays signed in when the email or
+	// password change; all others are revoked.
+	KeepSession string
+}
+
+func (update UserUpdate) applyProfile(user *User) {
+	if update.DisplayName != nil {
+		user.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		user.Bio = *update.Bio
+	}
+	if update.AvatarURL != nil {
+		user.AvatarURL = *update.AvatarURL
+	}
+}
+
+// ErrNoChange is returned by ModerateChirp and ModerateUser when the chirp
+// or user is already in the state the action would put it in, and by
+// RestoreChirp for chirps that aren't deleted.
+var ErrNoChange = errors.New("Nothing to change.")
+
+// ErrAlreadyReported is returned by CreateReport when the reporter has
+// reported the chirp before.
+var ErrAlreadyReported = errors.New("You already reported this chirp.")
+
+// ErrEventProcessed is returned by ProcessChirpyRedEvent for events that
+// were already applied.
+var ErrEventProcessed = errors.New("Event was already processed.")
+
+// ErrUserNotFound is returned by GetUser, ModerateUser and
+// ProcessChirpyRedEvent for unknown users.
+var ErrUserNotFound = errors.New("User doesn't exist")
+
+// ErrChirpNotFound is returned by ModerateChirp and RestoreChirp for
+// unknown chirps.
+var ErrChirpNotFound = errors.New("Chirp doesn't exist")
+
+// ErrRestoreExpired is returned by RestoreChirp for chirps deleted before
+// the restore window, which are waiting to be purged.
+var ErrRestoreExpired = errors.New("Restore window has passed.")
+
+// ErrEmailTaken is returned when another user already has the email.
+var ErrEmailTaken = errors.New("User with that email already exists.")
+
+// ErrInvalidCredentials is returned by AuthorizeUser for both unknown
+// emails and wrong passwords, so callers can't tell which it was.
+var ErrInvalidCredentials = errors.New("Incorrect email or password.")
+
+// ErrEmailChanged is returned by VerifyEmail when the user's email is no
+// longer the verified address.
+var ErrEmailChanged = errors.New("Email address has changed since the verification was sent.")
+
+// ErrResetTokenInvalid is returned by ResetPassword for unknown, used and
+// expired reset tokens alike.
+var ErrResetTokenInvalid = errors.New("Reset token is invalid or has expired.")
+
+// dummyHash is compared against when no user has the email, so that failed
+// logins take as long whether or not the account exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("chirpy-dummy-password"), bcrypt.DefaultCost)
+
+// checkPassword compares password with the user's hash, or with dummyHash
+// when the user wasn't found.
+func checkPassword(user User, found bool, password string) error {
+	hash := []byte(user.Password)
+	if !found {
+		hash = dummyHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil || !found {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Errors returned by the refresh token and session methods.
+var (
+	ErrTokenNotFound = errors.New("Refresh token not found.")
+	ErrTokenRevoked  = errors.New("Refresh token has been revoked.")
+	ErrTokenExpired  = errors.New("Refresh token has expired.")
+	ErrTokenReused   = errors.New("Refresh token was already used; all tokens of this login are revoked.")
+	ErrTokenDevice   = errors.New("Refresh token was issued to a different device.")
+
+	ErrSessionNotFound = errors.New("Session not found.")
+
+	ErrTokenUsed = errors.New("Token has already been used.")
+)
+
+// checkRotation reports why current can't be exchanged for next. On
+// ErrTokenReused the caller must revoke the token's family.
+func checkRotation(current, next RefreshToken) error {
+	if !current.RevokedAt.IsZero() {
+		return ErrTokenRevoked
+	}
+	if !current.RotatedAt.IsZero() {
+		return ErrTokenReused
+	}
+	if current.DeviceID != "" && current.DeviceID != next.DeviceID {
+		return ErrTokenDevice
+	}
+	if !next.CreatedAt.Before(current.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
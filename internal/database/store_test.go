@@ -0,0 +1,1485 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// storeTests is the conformance suite every Store implementation must pass.
+// Each test gets a fresh, empty store.
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, s Store)
+}{
+	{"Chirps", testStoreChirps},
+	{"SoftDelete", testStoreSoftDelete},
+	{"IDsNotReused", testStoreIDsNotReused},
+	{"QueryChirps", testStoreQueryChirps},
+	{"ChirpRevisions", testStoreChirpRevisions},
+	{"Users", testStoreUsers},
+	{"UpdateUser", testStoreUpdateUser},
+	{"VerifyEmail", testStoreVerifyEmail},
+	{"DeleteUser", testStoreDeleteUser},
+	{"Roles", testStoreRoles},
+	{"ModerateChirp", testStoreModerateChirp},
+	{"ModerateUser", testStoreModerateUser},
+	{"ModerationLog", testStoreModerationLog},
+	{"Reports", testStoreReports},
+	{"ResolveReports", testStoreResolveReports},
+	{"DismissReports", testStoreDismissReports},
+	{"PurgeReportedChirp", testStorePurgeReportedChirp},
+	{"PasswordReset", testStorePasswordReset},
+	{"ChirpyRed", testStoreChirpyRed},
+	{"RefreshTokens", testStoreRefreshTokens},
+	{"Sessions", testStoreSessions},
+	{"DeniedTokens", testStoreDeniedTokens},
+	{"PruneTokens", testStorePruneTokens},
+	{"Webhooks", testStoreWebhooks},
+}
+
+// runStoreTests runs the conformance suite against the stores returned by
+// open.
+func runStoreTests(t *testing.T, open func(t *testing.T) Store) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			tt.run(t, s)
+		})
+	}
+}
+
+func mustCreateUser(t *testing.T, s Store, email string) User {
+	t.Helper()
+	user, err := s.CreateUser(email, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func mustCreateChirp(t *testing.T, s Store, body string, authorID int) Chirp {
+	t.Helper()
+	chirp, err := s.CreateChirp(body, authorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chirp
+}
+
+func testStoreChirps(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	first := mustCreateChirp(t, s, "first", user.ID)
+	second := mustCreateChirp(t, s, "second", user.ID)
+	if first.ID == second.ID {
+		t.Fatalf("both chirps got ID %d", first.ID)
+	}
+
+	got, err := s.GetChirpById(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Body != "first" || got.AuthorID != user.ID {
+		t.Errorf("GetChirpById() = %+v, want body first by %d", got, user.ID)
+	}
+	chirps, err := s.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("GetChirps() returned %d chirps, want 2", len(chirps))
+	}
+
+	err = s.DeleteChirp(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err = s.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].ID != second.ID {
+		t.Errorf("GetChirps() after delete = %v, want only %d", chirpIDs(chirps), second.ID)
+	}
+	if _, err := s.GetChirpById(second.ID); err != nil {
+		t.Errorf("other chirp is gone after delete: %v", err)
+	}
+	if err := s.DeleteChirp(second.ID + 100); err == nil {
+		t.Error("DeleteChirp() accepted an unknown chirp")
+	}
+}
+
+func testStoreSoftDelete(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	kept := mustCreateChirp(t, s, "kept", user.ID)
+	restored := mustCreateChirp(t, s, "restored", user.ID)
+	purged := mustCreateChirp(t, s, "purged", user.ID)
+	for _, id := range []int{restored.ID, purged.ID} {
+		err := s.DeleteChirp(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.GetChirpById(restored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsDeleted() {
+		t.Errorf("GetChirpById() = %+v for a deleted chirp, want DeletedAt set", got)
+	}
+	chirps, _, err := s.QueryChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := chirpIDs(chirps); !equalIDs(ids, []int{kept.ID}) {
+		t.Errorf("QueryChirps() = %v, want only %d", ids, kept.ID)
+	}
+	if count, err := s.CountChirps(user.ID); err != nil || count != 1 {
+		t.Errorf("CountChirps() = %d, %v; want 1", count, err)
+	}
+
+	if _, err := s.RestoreChirp(restored.ID, time.Now().Add(time.Second)); !errors.Is(err, ErrRestoreExpired) {
+		t.Errorf("RestoreChirp() outside the window = %v, want ErrRestoreExpired", err)
+	}
+	if _, err := s.RestoreChirp(kept.ID, time.Time{}); !errors.Is(err, ErrNoChange) {
+		t.Errorf("RestoreChirp() of a live chirp = %v, want ErrNoChange", err)
+	}
+	if _, err := s.RestoreChirp(9999, time.Time{}); !errors.Is(err, ErrChirpNotFound) {
+		t.Errorf("RestoreChirp() of a missing chirp = %v, want ErrChirpNotFound", err)
+	}
+	got, err = s.RestoreChirp(restored.ID, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IsDeleted() || got.Body != "restored" {
+		t.Errorf("RestoreChirp() = %+v, want the chirp undeleted", got)
+	}
+
+	n, err := s.PurgeChirps(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeChirps() = %d, want 1", n)
+	}
+	if _, err := s.GetChirpById(purged.ID); err == nil {
+		t.Error("purged chirp is still returned")
+	}
+	if _, err := s.GetChirpRevisions(purged.ID); err == nil {
+		t.Error("purged chirp still has revisions")
+	}
+	for _, id := range []int{kept.ID, restored.ID} {
+		if _, err := s.GetChirpById(id); err != nil {
+			t.Errorf("chirp %d is gone after purge: %v", id, err)
+		}
+	}
+}
+
+func testStoreIDsNotReused(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	mustCreateChirp(t, s, "first", user.ID)
+	last := mustCreateChirp(t, s, "second", user.ID)
+	err := s.DeleteChirp(last.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := mustCreateChirp(t, s, "third", user.ID)
+	if next.ID <= last.ID {
+		t.Errorf("new chirp got ID %d, want more than the deleted %d", next.ID, last.ID)
+	}
+}
+
+func chirpIDs(chirps []Chirp) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testStoreQueryChirps(t *testing.T, s Store) {
+	a := mustCreateUser(t, s, "a@example.com")
+	b := mustCreateUser(t, s, "b@example.com")
+	// Chirps 1, 3 and 5 are by a; 2 and 4 by b.
+	ids := []int{}
+	for i := 0; i < 5; i++ {
+		author := a.ID
+		if i%2 == 1 {
+			author = b.ID
+		}
+		ids = append(ids, mustCreateChirp(t, s, "chirp", author).ID)
+	}
+
+	tests := []struct {
+		name     string
+		query    ChirpQuery
+		want     []int
+		wantNext int
+	}{
+		{"all", ChirpQuery{}, ids, 0},
+		{"descending", ChirpQuery{Descending: true}, []int{ids[4], ids[3], ids[2], ids[1], ids[0]}, 0},
+		{"author", ChirpQuery{AuthorID: a.ID}, []int{ids[0], ids[2], ids[4]}, 0},
+		{"unknown author", ChirpQuery{AuthorID: b.ID + 100}, []int{}, 0},
+		{"first page", ChirpQuery{Limit: 2}, []int{ids[0], ids[1]}, ids[1]},
+		{"next page", ChirpQuery{Limit: 2, After: ids[1]}, []int{ids[2], ids[3]}, ids[3]},
+		{"last page", ChirpQuery{Limit: 2, After: ids[3]}, []int{ids[4]}, 0},
+		{"exact last page", ChirpQuery{Limit: 3, After: ids[1]}, []int{ids[2], ids[3], ids[4]}, 0},
+		{"descending page", ChirpQuery{Descending: true, Limit: 2, After: ids[3]}, []int{ids[2], ids[1]}, ids[1]},
+		{"author page", ChirpQuery{AuthorID: a.ID, Limit: 1, After: ids[0]}, []int{ids[2]}, ids[2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirps, next, err := s.QueryChirps(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIDs(chirps); !equalIDs(got, tt.want) || next != tt.wantNext {
+				t.Errorf("QueryChirps(%+v) = %v, next %d; want %v, next %d", tt.query, got, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func testStoreChirpRevisions(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	before := time.Now().Add(-time.Second)
+	chirp := mustCreateChirp(t, s, "first", user.ID)
+	if chirp.CreatedAt.Before(before) || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("new chirp created %v, updated %v; want both now", chirp.CreatedAt, chirp.UpdatedAt)
+	}
+
+	updated, err := s.UpdateChirp(chirp.ID, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Body != "second" || !updated.CreatedAt.Equal(chirp.CreatedAt) || updated.UpdatedAt.Before(chirp.UpdatedAt) {
+		t.Errorf("UpdateChirp() = %+v, want body second, created %v", updated, chirp.CreatedAt)
+	}
+	got, err := s.GetChirpById(chirp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Body != "second" || !got.UpdatedAt.Equal(updated.UpdatedAt) {
+		t.Errorf("GetChirpById() = %+v after update, want %+v", got, updated)
+	}
+	_, err = s.UpdateChirp(chirp.ID, "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := s.GetChirpRevisions(chirp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{}
+	for _, revision := range revisions {
+		bodies = append(bodies, revision.Body)
+	}
+	if len(bodies) != 3 || bodies[0] != "first" || bodies[1] != "second" || bodies[2] != "third" {
+		t.Errorf("revisions = %q, want first, second, third", bodies)
+	}
+
+	if _, err := s.UpdateChirp(chirp.ID+100, "body"); err == nil {
+		t.Error("UpdateChirp() accepted an unknown chirp")
+	}
+	if _, err := s.GetChirpRevisions(chirp.ID + 100); err == nil {
+		t.Error("GetChirpRevisions() accepted an unknown chirp")
+	}
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	if user.Password == "password" {
+		t.Error("password stored in plain text")
+	}
+	if _, err := s.CreateUser("a@example.com", "other"); err == nil {
+		t.Error("CreateUser() accepted a taken email")
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		ok       bool
+	}{
+		{"right password", "a@example.com", "password", true},
+		{"wrong password", "a@example.com", "wrong", false},
+		{"unknown email", "b@example.com", "password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.AuthorizeUser(tt.email, tt.password)
+			if (err == nil) != tt.ok {
+				t.Fatalf("AuthorizeUser() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && got.ID != user.ID {
+				t.Errorf("AuthorizeUser() returned user %d, want %d", got.ID, user.ID)
+			}
+		})
+	}
+
+	email, password := "b@example.com", "secret"
+	updated, err := s.UpdateUser(user.ID, UserUpdate{Email: &email, Password: &password, CurrentPassword: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Email != "b@example.com" {
+		t.Errorf("UpdateUser() email = %q, want b@example.com", updated.Email)
+	}
+	if _, err := s.AuthorizeUser("b@example.com", "secret"); err != nil {
+		t.Errorf("can't log in with the updated credentials: %v", err)
+	}
+	if _, err := s.UpdateUser(user.ID+100, UserUpdate{Password: &password, CurrentPassword: "secret"}); err == nil {
+		t.Error("UpdateUser() accepted an unknown user")
+	}
+}
+
+func testStoreUpdateUser(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	mustCreateUser(t, s, "b@example.com")
+	now := time.Now().UTC()
+	hour := now.Add(time.Hour)
+	mustCreateSession(t, s, "current", user.ID, hour, RefreshToken{Hash: "current1", CreatedAt: now, ExpiresAt: hour})
+	mustCreateSession(t, s, "other", user.ID, hour, RefreshToken{Hash: "other1", CreatedAt: now, ExpiresAt: hour})
+	taken, email, password := "b@example.com", "c@example.com", "secret"
+
+	tests := []struct {
+		name    string
+		update  UserUpdate
+		wantErr error
+	}{
+		{"wrong current password", UserUpdate{Password: &password, CurrentPassword: "wrong"}, ErrInvalidCredentials},
+		{"no current password", UserUpdate{Email: &email}, ErrInvalidCredentials},
+		{"email taken", UserUpdate{Email: &taken, CurrentPassword: "password"}, ErrEmailTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.UpdateUser(user.ID, tt.update)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateUser() error = %v, want %v", err, tt.wantErr)
+			}
+			got, err := s.GetUser(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Email != "a@example.com" {
+				t.Errorf("failed update changed the email to %q", got.Email)
+			}
+		})
+	}
+
+	// Profile changes need no password and sign nobody out.
+	unchanged, name, bio := "a@example.com", "Ann", "Hi"
+	got, err := s.UpdateUser(user.ID, UserUpdate{Email: &unchanged, DisplayName: &name, Bio: &bio})
+	if err != nil {
+		t.Fatalf("profile update: %v", err)
+	}
+	if got.DisplayName != "Ann" || got.Bio != "Hi" || got.AvatarURL != "" {
+		t.Errorf("profile = %q, %q, %q; want Ann, Hi and no avatar", got.DisplayName, got.Bio, got.AvatarURL)
+	}
+	if got, err := s.GetUser(user.ID); err != nil || got.DisplayName != "Ann" {
+		t.Errorf("GetUser() = %+v, %v; want display name Ann", got, err)
+	}
+	if sessions, err := s.GetSessions(user.ID); err != nil || len(sessions) != 2 {
+		t.Fatalf("profile update left %d sessions, %v; want 2", len(sessions), err)
+	}
+
+	// A password change alone keeps the email and only the current session.
+	_, err = s.UpdateUser(user.ID, UserUpdate{Password: &password, CurrentPassword: "password", KeepSession: "current"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthorizeUser("a@example.com", "secret"); err != nil {
+		t.Errorf("can't log in with the new password: %v", err)
+	}
+	sessions, err := s.GetSessions(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); len(ids) != 1 || ids[0] != "current" {
+		t.Errorf("sessions after a password change = %v, want [current]", ids)
+	}
+	if _, err := s.RotateRefreshToken("other1", RefreshToken{Hash: "other2", CreatedAt: now, ExpiresAt: hour}); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("other session's refresh token: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := s.RotateRefreshToken("current1", RefreshToken{Hash: "current2", CreatedAt: now, ExpiresAt: hour}); err != nil {
+		t.Errorf("kept session's refresh token: %v", err)
+	}
+}
+
+func testStoreDeleteUser(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	other := mustCreateUser(t, s, "b@example.com")
+	now := time.Now().UTC()
+	hour := now.Add(time.Hour)
+	chirp := mustCreateChirp(t, s, "first", user.ID)
+	if _, err := s.UpdateChirp(chirp.ID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	deleted := mustCreateChirp(t, s, "deleted", user.ID)
+	if err := s.DeleteChirp(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	kept := mustCreateChirp(t, s, "kept", other.ID)
+	mustCreateSession(t, s, "session", user.ID, hour, RefreshToken{Hash: "token", DeviceID: "phone", CreatedAt: now, ExpiresAt: hour})
+	mustCreateSession(t, s, "other", other.ID, hour, RefreshToken{Hash: "other1", CreatedAt: now, ExpiresAt: hour})
+	err := s.CreatePasswordReset(PasswordReset{Hash: "reset", UserID: user.ID, CreatedAt: now, ExpiresAt: hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.ExportUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.User.ID != user.ID || data.User.Email != "a@example.com" {
+		t.Errorf("exported user = %+v, want %d a@example.com", data.User, user.ID)
+	}
+	if ids := chirpIDs(data.Chirps); !equalIDs(ids, []int{chirp.ID, deleted.ID}) {
+		t.Errorf("exported chirps = %v, want [%d %d]", ids, chirp.ID, deleted.ID)
+	}
+	if len(data.ChirpRevisions) != 3 || len(data.Sessions) != 1 || len(data.RefreshTokens) != 1 || len(data.PasswordResets) != 1 {
+		t.Errorf("exported %d revisions, %d sessions, %d refresh tokens, %d resets; want 3, 1, 1, 1",
+			len(data.ChirpRevisions), len(data.Sessions), len(data.RefreshTokens), len(data.PasswordResets))
+	}
+	if len(data.RefreshTokens) == 1 && data.RefreshTokens[0].DeviceID != "phone" {
+		t.Errorf("exported refresh token = %+v, want device phone", data.RefreshTokens[0])
+	}
+	if _, err := s.ExportUser(user.ID + 100); err == nil {
+		t.Error("ExportUser() accepted an unknown user")
+	}
+
+	if err := s.DeleteUser(user.ID, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong password: error = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if _, err := s.GetUser(user.ID); err != nil {
+		t.Fatalf("user deleted despite the wrong password: %v", err)
+	}
+	err = s.DeleteUser(user.ID, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(user.ID); err == nil {
+		t.Error("GetUser() found the deleted user")
+	}
+	if _, err := s.AuthorizeUser("a@example.com", "password"); err == nil {
+		t.Error("deleted user can still log in")
+	}
+	if _, err := s.GetChirpById(chirp.ID); err == nil {
+		t.Error("deleted user's chirp survived")
+	}
+	if _, err := s.RotateRefreshToken("token", RefreshToken{Hash: "next", CreatedAt: now, ExpiresAt: hour}); err == nil {
+		t.Error("deleted user's refresh token still works")
+	}
+	if _, err := s.ResetPassword("reset", "new"); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("deleted user's reset: error = %v, want %v", err, ErrResetTokenInvalid)
+	}
+	if _, err := s.CreateChirp("ghost", user.ID); err == nil {
+		t.Error("CreateChirp() accepted the deleted user as author")
+	}
+	if _, err := s.GetChirpById(kept.ID); err != nil {
+		t.Errorf("other user's chirp was deleted: %v", err)
+	}
+	if sessions, err := s.GetSessions(other.ID); err != nil || len(sessions) != 1 {
+		t.Errorf("other user has %d sessions, %v; want 1", len(sessions), err)
+	}
+	// The email is free again.
+	mustCreateUser(t, s, "a@example.com")
+}
+
+func testStoreRoles(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	if user.Role != RoleUser {
+		t.Errorf("new user's role = %q, want %q", user.Role, RoleUser)
+	}
+	updated, err := s.SetUserRole(user.ID, RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Role != RoleModerator {
+		t.Errorf("SetUserRole() role = %q, want %q", updated.Role, RoleModerator)
+	}
+	if got, err := s.GetUser(user.ID); err != nil || got.Role != RoleModerator {
+		t.Errorf("GetUser() = %+v, %v; want a moderator", got, err)
+	}
+	if got, err := s.AuthorizeUser("a@example.com", "password"); err != nil || got.Role != RoleModerator {
+		t.Errorf("AuthorizeUser() = %+v, %v; want a moderator", got, err)
+	}
+	if _, err := s.SetUserRole(user.ID+100, RoleAdmin); err == nil {
+		t.Error("SetUserRole() accepted an unknown user")
+	}
+	mustCreateUser(t, s, "b@example.com")
+	for role, want := range map[Role]int{RoleUser: 1, RoleModerator: 1, RoleAdmin: 0} {
+		if count, err := s.CountUsers(role); err != nil || count != want {
+			t.Errorf("CountUsers(%q) = %d, %v; want %d", role, count, err, want)
+		}
+	}
+}
+
+func testStoreModerateChirp(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	hidden := mustCreateChirp(t, s, "Spam Offer", author.ID)
+	visible := mustCreateChirp(t, s, "hello", author.ID)
+	removed := mustCreateChirp(t, s, "gone", author.ID)
+	deleted := mustCreateChirp(t, s, "deleted spam", author.ID)
+	if err := s.DeleteChirp(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	moderate := func(action ModerationAction, chirpID int) (Chirp, error) {
+		return s.ModerateChirp(ModerationEntry{ModeratorID: moderator.ID, Action: action, ChirpID: chirpID, Reason: "spam"})
+	}
+
+	got, err := moderate(ActionHideChirp, hidden.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsHidden() || got.HiddenReason != "spam" || got.IsVisible() {
+		t.Errorf("hidden chirp = %+v, want hidden for spam", got)
+	}
+	if _, err := moderate(ActionHideChirp, hidden.ID); !errors.Is(err, ErrNoChange) {
+		t.Errorf("hiding twice: error = %v, want %v", err, ErrNoChange)
+	}
+	if _, err := moderate(ActionUnhideChirp, visible.ID); !errors.Is(err, ErrNoChange) {
+		t.Errorf("unhiding a visible chirp: error = %v, want %v", err, ErrNoChange)
+	}
+	if _, err := moderate(ActionHideChirp, 99); !errors.Is(err, ErrChirpNotFound) {
+		t.Errorf("unknown chirp: error = %v, want %v", err, ErrChirpNotFound)
+	}
+	if _, err := moderate(ActionSuspendUser, visible.ID); err == nil {
+		t.Error("ModerateChirp() accepted a user action")
+	}
+	if _, err := moderate(ActionDeleteChirp, removed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetChirpById(removed.ID); err == nil {
+		t.Error("GetChirpById() found a chirp deleted by a moderator")
+	}
+	if _, err := s.GetChirpRevisions(removed.ID); err == nil {
+		t.Error("GetChirpRevisions() found revisions of a chirp deleted by a moderator")
+	}
+
+	statuses := []struct {
+		status ChirpStatus
+		want   []int
+	}{
+		{ChirpsVisible, []int{visible.ID}},
+		{ChirpsHidden, []int{hidden.ID}},
+		{ChirpsDeleted, []int{deleted.ID}},
+		{ChirpsAll, []int{hidden.ID, visible.ID, deleted.ID}},
+	}
+	for _, tt := range statuses {
+		chirps, _, err := s.QueryChirps(ChirpQuery{Status: tt.status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := chirpIDs(chirps); !equalIDs(ids, tt.want) {
+			t.Errorf("QueryChirps(status %q) = %v, want %v", tt.status, ids, tt.want)
+		}
+	}
+	chirps, _, err := s.QueryChirps(ChirpQuery{Status: ChirpsAll, Contains: "SPAM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := chirpIDs(chirps); !equalIDs(ids, []int{hidden.ID, deleted.ID}) {
+		t.Errorf("QueryChirps(contains SPAM) = %v, want [%d %d]", ids, hidden.ID, deleted.ID)
+	}
+	all, err := s.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := chirpIDs(all); !equalIDs(ids, []int{visible.ID}) {
+		t.Errorf("GetChirps() = %v, want only %d", ids, visible.ID)
+	}
+	if count, err := s.CountChirps(author.ID); err != nil || count != 1 {
+		t.Errorf("CountChirps() = %d, %v; want 1", count, err)
+	}
+
+	got, err = moderate(ActionUnhideChirp, hidden.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IsHidden() || got.HiddenReason != "" {
+		t.Errorf("unhidden chirp = %+v, want visible", got)
+	}
+}
+
+func testStoreModerateUser(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	now := time.Now().UTC()
+	hour := now.Add(time.Hour)
+	mustCreateSession(t, s, "session", user.ID, hour, RefreshToken{Hash: "token", CreatedAt: now, ExpiresAt: hour})
+	moderate := func(action ModerationAction, userID int) (User, error) {
+		return s.ModerateUser(ModerationEntry{ModeratorID: moderator.ID, Action: action, UserID: userID, Reason: "abuse"})
+	}
+
+	if _, err := moderate(ActionUnsuspendUser, user.ID); !errors.Is(err, ErrNoChange) {
+		t.Errorf("unsuspending an active user: error = %v, want %v", err, ErrNoChange)
+	}
+	got, err := moderate(ActionSuspendUser, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsSuspended() || got.SuspendedReason != "abuse" {
+		t.Errorf("suspended user = %+v, want suspended for abuse", got)
+	}
+	if got, err := s.GetUser(user.ID); err != nil || !got.IsSuspended() {
+		t.Errorf("GetUser() = %+v, %v; want suspended", got, err)
+	}
+	// Suspending signs the user out everywhere.
+	if _, err := s.RotateRefreshToken("token", RefreshToken{Hash: "next", CreatedAt: now, ExpiresAt: hour}); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("refresh after suspension: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := moderate(ActionSuspendUser, user.ID); !errors.Is(err, ErrNoChange) {
+		t.Errorf("suspending twice: error = %v, want %v", err, ErrNoChange)
+	}
+	if _, err := moderate(ActionSuspendUser, 99); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: error = %v, want %v", err, ErrUserNotFound)
+	}
+	if _, err := moderate(ActionHideChirp, user.ID); err == nil {
+		t.Error("ModerateUser() accepted a chirp action")
+	}
+
+	got, err = moderate(ActionUnsuspendUser, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IsSuspended() || got.SuspendedReason != "" {
+		t.Errorf("unsuspended user = %+v, want active", got)
+	}
+}
+
+func testStoreModerationLog(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	other := mustCreateUser(t, s, "other@example.com")
+	chirp := mustCreateChirp(t, s, "chirp", author.ID)
+	steps := []ModerationEntry{
+		{ModeratorID: moderator.ID, Action: ActionHideChirp, ChirpID: chirp.ID, Reason: "spam"},
+		{ModeratorID: moderator.ID, Action: ActionUnhideChirp, ChirpID: chirp.ID},
+		{ModeratorID: other.ID, Action: ActionSuspendUser, UserID: author.ID, Reason: "abuse"},
+	}
+	for _, step := range steps {
+		var err error
+		if step.ChirpID != 0 {
+			_, err = s.ModerateChirp(step)
+		} else {
+			_, err = s.ModerateUser(step)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Failed actions aren't logged.
+	if _, err := s.ModerateUser(ModerationEntry{ModeratorID: other.ID, Action: ActionSuspendUser, UserID: author.ID}); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("suspending twice: error = %v, want %v", err, ErrNoChange)
+	}
+
+	entries, next, err := s.GetModerationLog(ModerationLogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || next != 0 {
+		t.Fatalf("GetModerationLog() = %d entries, next %d; want 3 and no next page", len(entries), next)
+	}
+	newest := entries[0]
+	if newest.Action != ActionSuspendUser || newest.UserID != author.ID || newest.ModeratorID != other.ID ||
+		newest.ChirpID != 0 || newest.Reason != "abuse" || newest.CreatedAt.IsZero() {
+		t.Errorf("newest entry = %+v, want the suspension of user %d", newest, author.ID)
+	}
+	// Chirp actions record the author as the user acted on.
+	if oldest := entries[2]; oldest.Action != ActionHideChirp || oldest.ChirpID != chirp.ID || oldest.UserID != author.ID {
+		t.Errorf("oldest entry = %+v, want hiding chirp %d by user %d", oldest, chirp.ID, author.ID)
+	}
+
+	queries := []struct {
+		name  string
+		query ModerationLogQuery
+		want  []ModerationAction
+	}{
+		{"moderator", ModerationLogQuery{ModeratorID: moderator.ID}, []ModerationAction{ActionUnhideChirp, ActionHideChirp}},
+		{"user", ModerationLogQuery{UserID: author.ID}, []ModerationAction{ActionSuspendUser, ActionUnhideChirp, ActionHideChirp}},
+		{"chirp", ModerationLogQuery{ChirpID: chirp.ID}, []ModerationAction{ActionUnhideChirp, ActionHideChirp}},
+		{"action", ModerationLogQuery{Action: ActionHideChirp}, []ModerationAction{ActionHideChirp}},
+		{"before", ModerationLogQuery{Before: entries[0].ID}, []ModerationAction{ActionUnhideChirp, ActionHideChirp}},
+	}
+	for _, tt := range queries {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := s.GetModerationLog(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions := []ModerationAction{}
+			for _, entry := range got {
+				actions = append(actions, entry.Action)
+			}
+			if fmt.Sprint(actions) != fmt.Sprint(tt.want) {
+				t.Errorf("actions = %v, want %v", actions, tt.want)
+			}
+		})
+	}
+
+	data, err := s.ExportUser(author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.ModerationLog) != 3 || data.ModerationLog[0].Action != ActionHideChirp {
+		t.Errorf("exported moderation log = %+v, want the three actions on the author, oldest first", data.ModerationLog)
+	}
+
+	page, next, err := s.GetModerationLog(ModerationLogQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || next != page[1].ID {
+		t.Fatalf("first page = %d entries, next %d; want 2 and a cursor", len(page), next)
+	}
+	page, next, err = s.GetModerationLog(ModerationLogQuery{Limit: 2, Before: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Action != ActionHideChirp || next != 0 {
+		t.Errorf("second page = %+v, next %d; want only the hide and no next page", page, next)
+	}
+}
+
+func mustCreateReport(t *testing.T, s Store, chirpID, reporterID int, hideAfter int) (Report, bool) {
+	t.Helper()
+	report, hidden, err := s.CreateReport(Report{ChirpID: chirpID, ReporterID: reporterID, Reason: ReasonSpam}, hideAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report, hidden
+}
+
+func testStoreReports(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "author@example.com")
+	reporters := []User{
+		mustCreateUser(t, s, "a@example.com"),
+		mustCreateUser(t, s, "b@example.com"),
+		mustCreateUser(t, s, "c@example.com"),
+	}
+	chirp := mustCreateChirp(t, s, "spam", author.ID)
+	other := mustCreateChirp(t, s, "fine", author.ID)
+
+	first, hidden := mustCreateReport(t, s, chirp.ID, reporters[0].ID, 2)
+	if hidden || first.ID == 0 || first.CreatedAt.IsZero() || first.Reason != ReasonSpam {
+		t.Errorf("first report = %+v, hidden %v; want a stored open report", first, hidden)
+	}
+	if _, _, err := s.CreateReport(Report{ChirpID: chirp.ID, ReporterID: reporters[0].ID, Reason: ReasonOther}, 2); !errors.Is(err, ErrAlreadyReported) {
+		t.Errorf("second report by the same user: error = %v, want %v", err, ErrAlreadyReported)
+	}
+	if _, _, err := s.CreateReport(Report{ChirpID: 99, ReporterID: reporters[0].ID, Reason: ReasonSpam}, 2); err == nil {
+		t.Error("CreateReport() accepted an unknown chirp")
+	}
+	mustCreateReport(t, s, other.ID, reporters[0].ID, 0)
+
+	// The second open report reaches the threshold and hides the chirp,
+	// which is logged without a moderator.
+	_, hidden = mustCreateReport(t, s, chirp.ID, reporters[1].ID, 2)
+	if !hidden {
+		t.Fatal("chirp wasn't hidden at the threshold")
+	}
+	got, err := s.GetChirpById(chirp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsHidden() {
+		t.Errorf("chirp = %+v, want hidden", got)
+	}
+	entries, _, err := s.GetModerationLog(ModerationLogQuery{ChirpID: chirp.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != ActionHideChirp || entries[0].ModeratorID != 0 || entries[0].UserID != author.ID {
+		t.Errorf("moderation log = %+v, want one automatic hide", entries)
+	}
+	if _, _, err := s.CreateReport(Report{ChirpID: chirp.ID, ReporterID: reporters[2].ID, Reason: ReasonSpam}, 2); err == nil {
+		t.Error("CreateReport() accepted a hidden chirp")
+	}
+
+	queries := []struct {
+		name  string
+		query ReportQuery
+		want  []int
+	}{
+		{"open", ReportQuery{}, []int{chirp.ID, other.ID, chirp.ID}},
+		{"chirp", ReportQuery{ChirpID: other.ID}, []int{other.ID}},
+		{"reason", ReportQuery{Reason: ReasonHate}, []int{}},
+		{"resolved", ReportQuery{Status: ReportsResolved}, []int{}},
+		{"after", ReportQuery{After: first.ID}, []int{other.ID, chirp.ID}},
+	}
+	for _, tt := range queries {
+		t.Run(tt.name, func(t *testing.T) {
+			reports, _, err := s.GetReports(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, report := range reports {
+				ids = append(ids, report.ChirpID)
+			}
+			if !equalIDs(ids, tt.want) {
+				t.Errorf("chirps of reports = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+	page, next, err := s.GetReports(ReportQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || next != page[1].ID {
+		t.Fatalf("first page = %d reports, next %d; want 2 and a cursor", len(page), next)
+	}
+	page, next, err = s.GetReports(ReportQuery{Limit: 2, After: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || next != 0 {
+		t.Errorf("second page = %d reports, next %d; want 1 and no next page", len(page), next)
+	}
+
+	data, err := s.ExportUser(reporters[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Reports) != 2 {
+		t.Errorf("exported %d reports, want 2", len(data.Reports))
+	}
+	// Deleting a user removes the reports they filed and those on their
+	// chirps.
+	err = s.DeleteUser(reporters[1].ID, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports, _, err := s.GetReports(ReportQuery{Status: ReportsAll}); err != nil || len(reports) != 2 {
+		t.Errorf("after deleting a reporter: %d reports, %v; want 2", len(reports), err)
+	}
+	err = s.DeleteUser(author.ID, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports, _, err := s.GetReports(ReportQuery{Status: ReportsAll}); err != nil || len(reports) != 0 {
+		t.Errorf("after deleting the author: %d reports, %v; want none", len(reports), err)
+	}
+}
+
+func testStoreResolveReports(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "author@example.com")
+	reporter := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	dismissed := mustCreateChirp(t, s, "dismissed", author.ID)
+	hidden := mustCreateChirp(t, s, "hidden", author.ID)
+	deleted := mustCreateChirp(t, s, "deleted", author.ID)
+	for _, chirp := range []Chirp{dismissed, hidden, deleted} {
+		mustCreateReport(t, s, chirp.ID, reporter.ID, 0)
+	}
+
+	if _, err := s.ResolveReports(99, moderator.ID, ResolutionDismissed, ""); !errors.Is(err, ErrNoChange) {
+		t.Errorf("resolving a chirp without reports: error = %v, want %v", err, ErrNoChange)
+	}
+	tests := []struct {
+		chirp      Chirp
+		resolution Resolution
+	}{
+		{dismissed, ResolutionDismissed},
+		{hidden, ResolutionHidden},
+		{deleted, ResolutionDeleted},
+	}
+	for _, tt := range tests {
+		resolved, err := s.ResolveReports(tt.chirp.ID, moderator.ID, tt.resolution, "checked")
+		if err != nil || resolved != 1 {
+			t.Fatalf("%s: ResolveReports() = %d, %v; want 1", tt.resolution, resolved, err)
+		}
+		if _, err := s.ResolveReports(tt.chirp.ID, moderator.ID, tt.resolution, "checked"); !errors.Is(err, ErrNoChange) {
+			t.Errorf("%s twice: error = %v, want %v", tt.resolution, err, ErrNoChange)
+		}
+		reports, _, err := s.GetReports(ReportQuery{ChirpID: tt.chirp.ID, Status: ReportsResolved})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != 1 || reports[0].Resolution != tt.resolution || reports[0].ResolverID != moderator.ID || reports[0].Note != "checked" || !reports[0].IsResolved() {
+			t.Errorf("%s: resolved reports = %+v", tt.resolution, reports)
+		}
+	}
+
+	if got, err := s.GetChirpById(dismissed.ID); err != nil || !got.IsVisible() {
+		t.Errorf("dismissed chirp = %+v, %v; want visible", got, err)
+	}
+	if got, err := s.GetChirpById(hidden.ID); err != nil || !got.IsHidden() || got.HiddenReason != "checked" {
+		t.Errorf("hidden chirp = %+v, %v; want hidden with the note", got, err)
+	}
+	if _, err := s.GetChirpById(deleted.ID); err == nil {
+		t.Error("deleted chirp still exists")
+	}
+	entries, _, err := s.GetModerationLog(ModerationLogQuery{ModeratorID: moderator.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != ActionDeleteChirp || entries[1].Action != ActionHideChirp {
+		t.Errorf("moderation log = %+v, want a hide and a delete", entries)
+	}
+}
+
+func testStoreDismissReports(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "author@example.com")
+	reporter := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	auto := mustCreateChirp(t, s, "brigaded", author.ID)
+	manual := mustCreateChirp(t, s, "spam", author.ID)
+	if _, hidden := mustCreateReport(t, s, auto.ID, reporter.ID, 1); !hidden {
+		t.Fatal("CreateReport() didn't hide the chirp at the threshold")
+	}
+	mustCreateReport(t, s, manual.ID, reporter.ID, 0)
+	_, err := s.ModerateChirp(ModerationEntry{ModeratorID: moderator.ID, Action: ActionHideChirp, ChirpID: manual.ID, Reason: "spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chirp := range []Chirp{auto, manual} {
+		_, err := s.ResolveReports(chirp.ID, moderator.ID, ResolutionDismissed, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := s.GetChirpById(auto.ID); err != nil || !got.IsVisible() {
+		t.Errorf("auto-hidden chirp after dismissal = %+v, %v; want visible", got, err)
+	}
+	if got, err := s.GetChirpById(manual.ID); err != nil || !got.IsHidden() {
+		t.Errorf("chirp hidden by a moderator after dismissal = %+v, %v; want hidden", got, err)
+	}
+	entries, _, err := s.GetModerationLog(ModerationLogQuery{ChirpID: auto.ID, Action: ActionUnhideChirp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ModeratorID != moderator.ID || entries[0].Reason != "Reports dismissed." {
+		t.Errorf("unhide log entries = %+v, want one by the moderator", entries)
+	}
+
+	// Confirming an automatic hide records it under the moderator, so the
+	// chirp no longer counts as hidden by reports.
+	confirmed := mustCreateChirp(t, s, "confirmed", author.ID)
+	mustCreateReport(t, s, confirmed.ID, reporter.ID, 1)
+	_, err = s.ResolveReports(confirmed.ID, moderator.ID, ResolutionHidden, "checked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetChirpById(confirmed.ID); err != nil || !got.IsHidden() || got.HiddenReason != "checked" {
+		t.Errorf("confirmed chirp = %+v, %v; want hidden with the note", got, err)
+	}
+	entries, _, err = s.GetModerationLog(ModerationLogQuery{ChirpID: confirmed.ID, Action: ActionHideChirp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ModeratorID != moderator.ID || entries[1].ModeratorID != 0 {
+		t.Errorf("hide log entries = %+v, want the moderator's after the automatic one", entries)
+	}
+}
+
+func testStorePurgeReportedChirp(t *testing.T, s Store) {
+	author := mustCreateUser(t, s, "author@example.com")
+	reporter := mustCreateUser(t, s, "a@example.com")
+	moderator := mustCreateUser(t, s, "mod@example.com")
+	chirp := mustCreateChirp(t, s, "reported", author.ID)
+	mustCreateReport(t, s, chirp.ID, reporter.ID, 0)
+	err := s.DeleteChirp(chirp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := s.PurgeChirps(time.Now().Add(time.Minute))
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeChirps() = %d, %v; want 1", purged, err)
+	}
+
+	reports, _, err := s.GetReports(ReportQuery{ChirpID: chirp.ID, Status: ReportsResolved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Resolution != ResolutionDeleted || reports[0].ResolverID != 0 || reports[0].Note != purgedNote {
+		t.Errorf("reports on a purged chirp = %+v, want resolved as deleted", reports)
+	}
+	if _, err := s.ResolveReports(chirp.ID, moderator.ID, ResolutionHidden, ""); !errors.Is(err, ErrNoChange) {
+		t.Errorf("resolving reports on a purged chirp: error = %v, want %v", err, ErrNoChange)
+	}
+}
+
+func testStoreVerifyEmail(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	if user.EmailVerified {
+		t.Error("new user's email is verified")
+	}
+	if _, err := s.VerifyEmail(user.ID, "old@example.com"); !errors.Is(err, ErrEmailChanged) {
+		t.Errorf("verifying another address: error = %v, want %v", err, ErrEmailChanged)
+	}
+	verified, err := s.VerifyEmail(user.ID, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.EmailVerified {
+		t.Error("VerifyEmail() didn't mark the email verified")
+	}
+	got, err := s.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "a@example.com" || !got.EmailVerified {
+		t.Errorf("GetUser() = %+v, want a verified a@example.com", got)
+	}
+
+	// A new address has to be verified again.
+	email := "b@example.com"
+	updated, err := s.UpdateUser(user.ID, UserUpdate{Email: &email, CurrentPassword: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.EmailVerified {
+		t.Error("changed email is still verified")
+	}
+	if _, err := s.GetUser(user.ID + 100); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUser() error = %v for an unknown user, want %v", err, ErrUserNotFound)
+	}
+	if _, err := s.VerifyEmail(user.ID+100, "a@example.com"); err == nil {
+		t.Error("VerifyEmail() accepted an unknown user")
+	}
+}
+
+func testStorePasswordReset(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	other := mustCreateUser(t, s, "b@example.com")
+	got, err := s.GetUserByEmail("a@example.com")
+	if err != nil || got.ID != user.ID {
+		t.Fatalf("GetUserByEmail() = %+v, %v; want user %d", got, err, user.ID)
+	}
+	if _, err := s.GetUserByEmail("c@example.com"); err == nil {
+		t.Error("GetUserByEmail() found an unknown email")
+	}
+
+	now := time.Now().UTC()
+	resets := []PasswordReset{
+		{Hash: "first", UserID: user.ID, ExpiresAt: now.Add(time.Hour)},
+		{Hash: "second", UserID: user.ID, ExpiresAt: now.Add(time.Hour)},
+		{Hash: "expired", UserID: user.ID, ExpiresAt: now.Add(-time.Minute)},
+		{Hash: "other", UserID: other.ID, ExpiresAt: now.Add(time.Hour)},
+	}
+	for _, reset := range resets {
+		reset.CreatedAt = now
+		err := s.CreatePasswordReset(reset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hour := now.Add(time.Hour)
+	mustCreateSession(t, s, "session", user.ID, hour, RefreshToken{Hash: "token", CreatedAt: now, ExpiresAt: hour})
+
+	if _, err := s.ResetPassword("expired", "new"); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("expired reset: error = %v, want %v", err, ErrResetTokenInvalid)
+	}
+	if _, err := s.ResetPassword("missing", "new"); !errors.Is(err, ErrResetTokenInvalid) {
+		t.Errorf("unknown reset: error = %v, want %v", err, ErrResetTokenInvalid)
+	}
+	got, err = s.ResetPassword("first", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("ResetPassword() reset user %d, want %d", got.ID, user.ID)
+	}
+	if _, err := s.AuthorizeUser("a@example.com", "new"); err != nil {
+		t.Errorf("can't log in with the new password: %v", err)
+	}
+	if _, err := s.AuthorizeUser("a@example.com", "password"); err == nil {
+		t.Error("old password still works")
+	}
+
+	// The used token and every other token of the user are spent.
+	for _, hash := range []string{"first", "second"} {
+		if _, err := s.ResetPassword(hash, "again"); !errors.Is(err, ErrResetTokenInvalid) {
+			t.Errorf("reset %s after a reset: error = %v, want %v", hash, err, ErrResetTokenInvalid)
+		}
+	}
+	if _, err := s.RotateRefreshToken("token", RefreshToken{Hash: "next", CreatedAt: now, ExpiresAt: hour}); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("session after a reset: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := s.ResetPassword("other", "new"); err != nil {
+		t.Errorf("another user's reset token was spent: %v", err)
+	}
+}
+
+func testStoreChirpyRed(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	isRed := func() bool {
+		t.Helper()
+		got, err := s.AuthorizeUser("a@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.IsChirpyRed
+	}
+
+	if isRed() {
+		t.Error("new user is Chirpy Red")
+	}
+	if err := s.ProcessChirpyRedEvent("", user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if !isRed() {
+		t.Error("upgraded user isn't Chirpy Red")
+	}
+	if err := s.ProcessChirpyRedEvent("", user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if isRed() {
+		t.Error("downgraded user is still Chirpy Red")
+	}
+	if err := s.ProcessChirpyRedEvent("", user.ID+100, true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ProcessChirpyRedEvent() = %v for an unknown user, want %v", err, ErrUserNotFound)
+	}
+}
+
+func testStoreRefreshTokens(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	now := time.Now().UTC()
+	// login stores a new session the way the login handler does.
+	login := func(family, hash, device string, ttl time.Duration) {
+		t.Helper()
+		mustCreateSession(t, s, family, user.ID, now.Add(ttl), RefreshToken{
+			Hash:      hash,
+			DeviceID:  device,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		})
+	}
+	rotate := func(hash, next, device string) (RefreshToken, error) {
+		return s.RotateRefreshToken(hash, RefreshToken{
+			Hash:      next,
+			DeviceID:  device,
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+		})
+	}
+
+	login("a", "a1", "", time.Hour)
+	got, err := rotate("a1", "a2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != user.ID || got.FamilyID != "a" || got.Hash != "a2" {
+		t.Errorf("RotateRefreshToken() = %+v, want a2 of user %d in family a", got, user.ID)
+	}
+	// Presenting a rotated token again revokes its whole family.
+	if _, err := rotate("a1", "a3", ""); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("reusing a rotated token: error = %v, want %v", err, ErrTokenReused)
+	}
+	if _, err := rotate("a2", "a4", ""); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("rotating the successor after reuse: error = %v, want %v", err, ErrTokenRevoked)
+	}
+
+	login("b", "b1", "phone", time.Hour)
+	if _, err := rotate("b1", "b2", "laptop"); !errors.Is(err, ErrTokenDevice) {
+		t.Errorf("rotating from another device: error = %v, want %v", err, ErrTokenDevice)
+	}
+	if _, err := rotate("b1", "b2", "phone"); err != nil {
+		t.Errorf("rotating from the same device: %v", err)
+	}
+
+	login("c", "c1", "", -time.Minute)
+	if _, err := rotate("c1", "c2", ""); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("rotating an expired token: error = %v, want %v", err, ErrTokenExpired)
+	}
+
+	login("d", "d1", "", time.Hour)
+	_, err = rotate("d1", "d2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RevokeRefreshToken("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotate("d2", "d3", ""); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("rotating after revoking the family: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := rotate("b2", "b3", "phone"); err != nil {
+		t.Errorf("revoking one family affected another: %v", err)
+	}
+
+	if _, err := rotate("missing", "x", ""); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("rotating an unknown token: error = %v, want %v", err, ErrTokenNotFound)
+	}
+	if err := s.RevokeRefreshToken("missing"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("revoking an unknown token: error = %v, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func mustCreateSession(t *testing.T, s Store, id string, userID int, expires time.Time, token RefreshToken) {
+	t.Helper()
+	now := time.Now().UTC()
+	err := s.CreateSession(Session{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  "test",
+		IP:         "127.0.0.1",
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expires,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessionIDs(sessions []Session) []string {
+	ids := []string{}
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+func testStoreSessions(t *testing.T, s Store) {
+	a := mustCreateUser(t, s, "a@example.com")
+	b := mustCreateUser(t, s, "b@example.com")
+	now := time.Now().UTC()
+	hour := now.Add(time.Hour)
+	mustCreateSession(t, s, "old", a.ID, hour, RefreshToken{Hash: "old1", CreatedAt: now, ExpiresAt: hour})
+	mustCreateSession(t, s, "new", a.ID, hour, RefreshToken{Hash: "new1", CreatedAt: now, ExpiresAt: hour})
+	mustCreateSession(t, s, "expired", a.ID, now.Add(-time.Minute), RefreshToken{Hash: "expired1", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)})
+	mustCreateSession(t, s, "other", b.ID, hour, RefreshToken{Hash: "other1", CreatedAt: now, ExpiresAt: hour})
+	// Refreshing "new" makes it the most recently used.
+	_, err := s.RotateRefreshToken("new1", RefreshToken{Hash: "new2", CreatedAt: now.Add(time.Second), ExpiresAt: hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := s.GetSessions(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); len(ids) != 2 || ids[0] != "new" || ids[1] != "old" {
+		t.Errorf("GetSessions() = %v, want [new old]", ids)
+	}
+
+	if err := s.RevokeSession(a.ID, "other"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking another user's session: error = %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := s.RevokeSession(a.ID, "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking an unknown session: error = %v, want %v", err, ErrSessionNotFound)
+	}
+	if got, err := s.GetSession(a.ID, "old"); err != nil || got.ID != "old" || !got.IsActive(now) {
+		t.Errorf("GetSession() = %+v, %v; want the active session old", got, err)
+	}
+	if _, err := s.GetSession(a.ID, "other"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("getting another user's session: error = %v, want %v", err, ErrSessionNotFound)
+	}
+	err = s.RevokeSession(a.ID, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RotateRefreshToken("old1", RefreshToken{Hash: "old2", CreatedAt: now, ExpiresAt: hour}); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("refreshing a revoked session: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	// Revoked sessions can still be looked up, so callers can tell them
+	// apart from unknown ones.
+	if got, err := s.GetSession(a.ID, "old"); err != nil || got.IsActive(now) {
+		t.Errorf("GetSession() of a revoked session = %+v, %v; want it inactive", got, err)
+	}
+	sessions, err = s.GetSessions(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); len(ids) != 1 || ids[0] != "new" {
+		t.Errorf("GetSessions() after revoke = %v, want [new]", ids)
+	}
+
+	revoked, err := s.RevokeAllSessions(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 1 {
+		t.Errorf("RevokeAllSessions() = %d, want 1", revoked)
+	}
+	if _, err := s.RotateRefreshToken("new2", RefreshToken{Hash: "new3", CreatedAt: now, ExpiresAt: hour}); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("refreshing after revoke-all: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	sessions, err = s.GetSessions(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sessionIDs(sessions); len(ids) != 1 {
+		t.Errorf("other user's sessions after revoke-all = %v, want [other]", ids)
+	}
+}
+
+func testStoreDeniedTokens(t *testing.T, s Store) {
+	err := s.DenyToken("revoked", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := s.IsTokenDenied("revoked")
+	if err != nil || !denied {
+		t.Errorf("IsTokenDenied() = %v, %v for a denied token, want true", denied, err)
+	}
+	denied, err = s.IsTokenDenied("other")
+	if err != nil || denied {
+		t.Errorf("IsTokenDenied() = %v, %v for another token, want false", denied, err)
+	}
+
+	err = s.ConsumeToken("single-use", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("ConsumeToken() = %v the first time, want nil", err)
+	}
+	err = s.ConsumeToken("single-use", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("ConsumeToken() = %v the second time, want %v", err, ErrTokenUsed)
+	}
+	denied, err = s.IsTokenDenied("single-use")
+	if err != nil || !denied {
+		t.Errorf("IsTokenDenied() = %v, %v for a consumed token, want true", denied, err)
+	}
+}
+
+func testStorePruneTokens(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	now := time.Now().UTC()
+	hour := now.Add(time.Hour)
+	for _, id := range []string{"active", "revoked-old", "revoked-recent"} {
+		mustCreateSession(t, s, id, user.ID, hour, RefreshToken{Hash: id, CreatedAt: now, ExpiresAt: hour})
+	}
+	past := now.Add(-time.Minute)
+	mustCreateSession(t, s, "expired", user.ID, past, RefreshToken{Hash: "expired", CreatedAt: past, ExpiresAt: past})
+	err := s.RevokeSession(user.ID, "revoked-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ProcessChirpyRedEvent("evt-old", user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	revokedBefore := time.Now()
+	err = s.RevokeSession(user.ID, "revoked-recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DenyToken may drop expired entries, so the expired one goes last.
+	err = s.DenyToken("live", hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DenyToken("dead", past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for hash, expires := range map[string]time.Time{"reset-live": hour, "reset-dead": past} {
+		err = s.CreatePasswordReset(PasswordReset{Hash: hash, UserID: user.ID, CreatedAt: past, ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := s.PruneTokens(time.Now(), revokedBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PruneStats{RefreshTokens: 2, Sessions: 2, DeniedTokens: 1, PasswordResets: 1}
+	if stats != want {
+		t.Errorf("PruneTokens() = %+v, want %+v", stats, want)
+	}
+
+	rotate := func(hash string) error {
+		_, err := s.RotateRefreshToken(hash, RefreshToken{Hash: hash + "-next", CreatedAt: time.Now(), ExpiresAt: hour})
+		return err
+	}
+	if err := rotate("active"); err != nil {
+		t.Errorf("active token after pruning: %v", err)
+	}
+	if err := rotate("revoked-recent"); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("recently revoked token: error = %v, want %v", err, ErrTokenRevoked)
+	}
+	for _, hash := range []string{"revoked-old", "expired"} {
+		if err := rotate(hash); !errors.Is(err, ErrTokenNotFound) {
+			t.Errorf("pruned token %s: error = %v, want %v", hash, err, ErrTokenNotFound)
+		}
+	}
+	if denied, err := s.IsTokenDenied("live"); err != nil || !denied {
+		t.Errorf("unexpired deny-list entry was pruned: %v, %v", denied, err)
+	}
+	if _, err := s.ResetPassword("reset-live", "new"); err != nil {
+		t.Errorf("unexpired password reset was pruned: %v", err)
+	}
+	// Processed event IDs are kept, or a captured request could be replayed.
+	if err := s.ProcessChirpyRedEvent("evt-old", user.ID, false); !errors.Is(err, ErrEventProcessed) {
+		t.Errorf("old event after pruning: error = %v, want %v", err, ErrEventProcessed)
+	}
+}
+
+func testStoreWebhooks(t *testing.T, s Store) {
+	user := mustCreateUser(t, s, "a@example.com")
+	err := s.ProcessChirpyRedEvent("evt_1", user.ID+100, true)
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("ProcessChirpyRedEvent() = %v for an unknown user, want %v", err, ErrUserNotFound)
+	}
+	err = s.ProcessChirpyRedEvent("evt_1", user.ID, true)
+	if err != nil {
+		t.Fatalf("ProcessChirpyRedEvent() = %v after a failed attempt, want nil", err)
+	}
+	err = s.ProcessChirpyRedEvent("evt_1", user.ID, false)
+	if !errors.Is(err, ErrEventProcessed) {
+		t.Errorf("ProcessChirpyRedEvent() = %v for a replayed event, want %v", err, ErrEventProcessed)
+	}
+	got, err := s.AuthorizeUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsChirpyRed {
+		t.Error("replayed event was applied")
+	}
+}
+
+func TestRole(t *testing.T) {
+	for _, name := range []string{"user", "moderator", "admin"} {
+		if role, err := ParseRole(name); err != nil || string(role) != name {
+			t.Errorf("ParseRole(%q) = %q, %v", name, role, err)
+		}
+	}
+	for _, name := range []string{"", "Admin", "root"} {
+		if _, err := ParseRole(name); err == nil {
+			t.Errorf("ParseRole(%q) accepted an unknown role", name)
+		}
+	}
+
+	tests := []struct {
+		role, min Role
+		want      bool
+	}{
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleUser, RoleModerator, false},
+		{RoleModerator, RoleAdmin, false},
+		{"", RoleUser, true},
+		{"root", RoleModerator, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.AtLeast(tt.min); got != tt.want {
+			t.Errorf("%q.AtLeast(%q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
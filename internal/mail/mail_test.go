@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	msg := format("from@example.com", Message{
+		To:      "to@example.com\r\nBcc: victim@example.com",
+		Subject: "Hello\nBcc: victim@example.com",
+		Body:    "line one\nline two",
+	})
+	header, body, found := strings.Cut(string(msg), "\r\n\r\n")
+	if !found {
+		t.Fatalf("no blank line between header and body in %q", msg)
+	}
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("header injected through a value: %q", header)
+		}
+	}
+	if body != "line one\r\nline two\r\n" {
+		t.Errorf("body = %q, want CRLF line endings", body)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	m := &FileMailer{Path: path, From: "from@example.com"}
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		err := m.Send(Message{To: to, Subject: "Hi", Body: "Hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: a@example.com\r\n", "To: b@example.com\r\n"} {
+		if !strings.Contains(string(dat), want) {
+			t.Errorf("mail file is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package ratelimit implements token-bucket rate limiting with a pluggable
+// bucket store.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests requests per Per, in bursts of up to Requests.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseLimit parses a limit written as "<requests>/<duration>", for example
+// "30/1m".
+func ParseLimit(s string) (Limit, error) {
+	requests, per, found := strings.Cut(s, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("rate limit %q: want <requests>/<duration>", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid request count", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid duration", s)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+// rate is the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until a request would be allowed; zero if
+	// this one was.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Store keeps token buckets. Implementations must be safe for concurrent
+// use; a shared backend lets several server instances enforce one budget.
+type Store interface {
+	// Take removes a token from the bucket for key, refilled according to
+	// limit up to now.
+	Take(key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Limiter applies one Limit to requests grouped by key.
+type Limiter struct {
+	name  string
+	limit Limit
+	store Store
+}
+
+// New returns a limiter whose buckets are stored in store under name, so
+// several limiters can share a store.
+func New(name string, limit Limit, store Store) *Limiter {
+	return &Limiter{name: name, limit: limit, store: store}
+}
+
+// Allow takes a token from the bucket for key.
+func (l *Limiter) Allow(key string) (Result, error) {
+	return l.store.Take(l.name+":"+key, l.limit, time.Now())
+}
+
+// SetHeaders sets the RateLimit-* headers describing result on h, plus
+// Retry-After when the request was rejected.
+func SetHeaders(h http.Header, result Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(result.ResetAfter)))
+	if !result.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
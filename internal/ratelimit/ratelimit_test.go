@@ -0,0 +1,201 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+		ok   bool
+	}{
+		{"30/1m", Limit{Requests: 30, Per: time.Minute}, true},
+		{"5/10s", Limit{Requests: 5, Per: 10 * time.Second}, true},
+		{"1/1h30m", Limit{Requests: 1, Per: 90 * time.Minute}, true},
+		{"30", Limit{}, false},
+		{"/1m", Limit{}, false},
+		{"0/1m", Limit{}, false},
+		{"-1/1m", Limit{}, false},
+		{"x/1m", Limit{}, false},
+		{"30/", Limit{}, false},
+		{"30/0s", Limit{}, false},
+		{"30/-1m", Limit{}, false},
+		{"30/minute", Limit{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLimit(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseLimit(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLimit(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := Limit{Requests: 3, Per: 3 * time.Second}
+	start := time.Unix(1700000000, 0)
+
+	// Each take happens at start plus after.
+	type take struct {
+		after      time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "burst",
+			takes: []take{
+				{0, true, 2, 0},
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, time.Second},
+			},
+		},
+		{
+			name: "partial refill",
+			takes: []take{
+				{0, true, 2, 0},
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+				{time.Second, true, 0, 0},
+			},
+		},
+		{
+			name: "refill caps at the burst",
+			takes: []take{
+				{0, true, 2, 0},
+				{time.Hour, true, 2, 0},
+				{time.Hour, true, 1, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			for i, tk := range tt.takes {
+				got, err := store.Take("key", limit, start.Add(tk.after))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Allowed != tk.allowed || got.Remaining != tk.remaining || got.RetryAfter != tk.retryAfter {
+					t.Fatalf("take %d = %+v, want allowed %v remaining %d retry after %v",
+						i, got, tk.allowed, tk.remaining, tk.retryAfter)
+				}
+				if got.Limit != limit.Requests {
+					t.Errorf("take %d: Limit = %d, want %d", i, got.Limit, limit.Requests)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	limit := Limit{Requests: 1, Per: time.Minute}
+	now := time.Now()
+	store := NewMemoryStore()
+
+	for _, key := range []string{"a", "b"} {
+		result, err := store.Take(key, limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed {
+			t.Errorf("first take for %s rejected", key)
+		}
+	}
+	result, err := store.Take("a", limit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Error("second take for a allowed")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	limit := Limit{Requests: 2, Per: time.Minute}
+	start := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+
+	store.Take("full", limit, start)
+	store.Take("busy", limit, start)
+	store.Take("busy", limit, start)
+	store.Take("busy", limit, start.Add(50*time.Second))
+	// The next take sweeps; "full" has refilled, "busy" hasn't.
+	store.Take("other", limit, start.Add(61*time.Second))
+
+	if _, ok := store.buckets["full"]; ok {
+		t.Error("refilled bucket wasn't swept")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Error("bucket that hasn't refilled was swept")
+	}
+}
+
+func TestLimiterNames(t *testing.T) {
+	limit := Limit{Requests: 1, Per: time.Minute}
+	store := NewMemoryStore()
+	login := New("login", limit, store)
+	chirps := New("chirps", limit, store)
+
+	for _, l := range []*Limiter{login, chirps} {
+		result, err := l.Allow("1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed {
+			t.Errorf("limiter %s shares a bucket with another limiter", l.name)
+		}
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		result Result
+		want   map[string]string
+	}{
+		{
+			name:   "allowed",
+			result: Result{Allowed: true, Limit: 10, Remaining: 9, ResetAfter: 1500 * time.Millisecond},
+			want: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "9",
+				"RateLimit-Reset":     "2",
+				"Retry-After":         "",
+			},
+		},
+		{
+			name:   "rejected",
+			result: Result{Limit: 10, RetryAfter: 100 * time.Millisecond, ResetAfter: time.Minute},
+			want: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "60",
+				"Retry-After":         "1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			SetHeaders(h, tt.result)
+			for name, want := range tt.want {
+				if got := h.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
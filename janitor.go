@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/takacs/go-web/internal/database"
+)
+
+// janitorStats records what runTokenJanitor has removed, for the admin
+// metrics page.
+type janitorStats struct {
+	mu      sync.Mutex
+	runs    int
+	lastRun time.Time
+	lastErr error
+	removed database.PruneStats
+}
+
+func (s *janitorStats) record(stats database.PruneStats, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs++
+	s.lastRun = time.Now()
+	s.lastErr = err
+	s.removed.RefreshTokens += stats.RefreshTokens
+	s.removed.Sessions += stats.Sessions
+	s.removed.DeniedTokens += stats.DeniedTokens
+	s.removed.PasswordResets += stats.PasswordResets
+}
+
+func (s *janitorStats) snapshot() (runs int, lastRun time.Time, lastErr error, removed database.PruneStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs, s.lastRun, s.lastErr, s.removed
+}
+
+// runTokenJanitor removes expired refresh tokens, sessions, deny-list
+// entries and password reset tokens, and those revoked or used more than
+// retention ago. It runs every interval until ctx is cancelled.
+func (cfg *apiConfig) runTokenJanitor(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			stats, err := cfg.DB.PruneTokens(now, now.Add(-retention))
+			cfg.janitor.record(stats, err)
+			if err != nil {
+				log.Printf("Failed to prune tokens: %v", err)
+				continue
+			}
+			if stats != (database.PruneStats{}) {
+				log.Printf("Pruned %d refresh tokens, %d sessions, %d denied tokens and %d password resets.",
+					stats.RefreshTokens, stats.Sessions, stats.DeniedTokens, stats.PasswordResets)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
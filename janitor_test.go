@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunTokenJanitor(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.janitor = &janitorStats{}
+	err := cfg.DB.DenyToken("expired", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cfg.runTokenJanitor(ctx, time.Millisecond, time.Hour)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs, _, _, _ := cfg.janitor.snapshot()
+		if runs > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	runs, lastRun, lastErr, removed := cfg.janitor.snapshot()
+	if runs == 0 || lastRun.IsZero() || lastErr != nil {
+		t.Fatalf("janitor stats: %d runs, last %v, error %v; want a successful run", runs, lastRun, lastErr)
+	}
+	if removed.DeniedTokens != 1 {
+		t.Errorf("removed %d denied tokens, want 1", removed.DeniedTokens)
+	}
+}
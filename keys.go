@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/takacs/go-web/internal/auth"
+)
+
+// loadKeyring builds the JWT keyring from the environment:
+//
+//	JWT_SECRET            HS256 secret, also used for tokens without a kid
+//	JWT_KEY_ID            kid of JWT_SECRET (default "default")
+//	JWT_PREVIOUS_SECRETS  retired HS256 secrets as kid:secret,kid:secret
+//	JWT_SIGNING_KEY_FILE  Ed25519 or RSA private key PEM; signs when set
+//	JWT_SIGNING_KEY_ID    kid of JWT_SIGNING_KEY_FILE (default derived)
+//	JWT_VERIFY_KEY_FILES  retired PEM keys, comma separated
+//	JWT_ALGORITHMS        accepted algorithms, e.g. EdDSA,RS256 (default all)
+func loadKeyring() (*auth.Keyring, error) {
+	var active, legacy *auth.Key
+	previous := []*auth.Key{}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		id := os.Getenv("JWT_KEY_ID")
+		if id == "" {
+			id = "default"
+		}
+		key, err := auth.NewHMACKey(id, []byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		active, legacy = key, key
+	}
+
+	if entries := os.Getenv("JWT_PREVIOUS_SECRETS"); entries != "" {
+		for _, entry := range strings.Split(entries, ",") {
+			id, secret, found := strings.Cut(entry, ":")
+			if !found || id == "" {
+				return nil, errors.New("JWT_PREVIOUS_SECRETS entries must be kid:secret")
+			}
+			key, err := auth.NewHMACKey(id, []byte(secret))
+			if err != nil {
+				return nil, fmt.Errorf("JWT_PREVIOUS_SECRETS %s: %w", id, err)
+			}
+			previous = append(previous, key)
+		}
+	}
+
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		key, err := auth.LoadPEMKey(path, os.Getenv("JWT_SIGNING_KEY_ID"))
+		if err != nil {
+			return nil, err
+		}
+		if !key.CanSign() {
+			return nil, errors.New("JWT_SIGNING_KEY_FILE must contain a private key")
+		}
+		if active != nil {
+			previous = append(previous, active)
+		}
+		active = key
+	}
+
+	if paths := os.Getenv("JWT_VERIFY_KEY_FILES"); paths != "" {
+		for _, path := range strings.Split(paths, ",") {
+			key, err := auth.LoadPEMKey(strings.TrimSpace(path), "")
+			if err != nil {
+				return nil, err
+			}
+			previous = append(previous, key)
+		}
+	}
+
+	if active == nil {
+		return nil, errors.New("set JWT_SECRET or JWT_SIGNING_KEY_FILE")
+	}
+	keys, err := auth.NewKeyring(active, previous...)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		err = keys.SetLegacyKey(legacy.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if algs := os.Getenv("JWT_ALGORITHMS"); algs != "" {
+		names := strings.Split(algs, ",")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+		err = keys.AllowAlgorithms(names...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
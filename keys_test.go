@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantErr  bool
+		wantAlgs []string
+	}{
+		{name: "nothing set", wantErr: true},
+		{name: "secret", env: map[string]string{"JWT_SECRET": "s"}, wantAlgs: []string{"HS256"}},
+		{name: "previous secrets", env: map[string]string{"JWT_SECRET": "s", "JWT_PREVIOUS_SECRETS": "a:x,b:y"}, wantAlgs: []string{"HS256"}},
+		{name: "previous secret without kid", env: map[string]string{"JWT_SECRET": "s", "JWT_PREVIOUS_SECRETS": "x"}, wantErr: true},
+		{name: "empty previous secret", env: map[string]string{"JWT_SECRET": "s", "JWT_PREVIOUS_SECRETS": "a:"}, wantErr: true},
+		{name: "missing key file", env: map[string]string{"JWT_SIGNING_KEY_FILE": "/nonexistent.pem"}, wantErr: true},
+		{name: "algorithm without the active key", env: map[string]string{"JWT_SECRET": "s", "JWT_ALGORITHMS": "EdDSA"}, wantErr: true},
+		{name: "algorithms with spaces", env: map[string]string{"JWT_SECRET": "s", "JWT_ALGORITHMS": "EdDSA, HS256"}, wantAlgs: []string{"HS256"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"JWT_SECRET", "JWT_KEY_ID", "JWT_PREVIOUS_SECRETS", "JWT_SIGNING_KEY_FILE", "JWT_SIGNING_KEY_ID", "JWT_VERIFY_KEY_FILES", "JWT_ALGORITHMS"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			keys, err := loadKeyring()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadKeyring() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			algs := keys.Algorithms()
+			if len(algs) != len(tt.wantAlgs) || algs[0] != tt.wantAlgs[0] {
+				t.Errorf("Algorithms() = %v, want %v", algs, tt.wantAlgs)
+			}
+		})
+	}
+}
@@ -1,19 +1,40 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
+	"github.com/takacs/go-web/internal/auth"
 	"github.com/takacs/go-web/internal/database"
+	"github.com/takacs/go-web/internal/mail"
+	"github.com/takacs/go-web/internal/ratelimit"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	jwt            string
-	DB             *database.DB
+	keys           *auth.Keyring
+	baseURL        string
+	polkaKey       string
+	polkaSecret    string
+	restoreWindow  time.Duration
+	reportsToHide  int
+	janitor        *janitorStats
+	loginAccounts  *auth.Throttle
+	loginIPs       *auth.Throttle
+	mailer         mail.Mailer
+	DB             database.Store
 }
 
 func main() {
@@ -22,38 +43,179 @@ func main() {
 
 	godotenv.Load()
 
-	db, err := database.NewDB("database.json")
+	repair := flag.Bool("repair", false, "check the JSON database for ID collisions and exit")
+	fix := flag.Bool("fix", false, "with -repair, rewrite the database with the collisions fixed")
+	flag.Parse()
+
+	if *repair {
+		runRepair(*fix)
+		return
+	}
+
+	restoreWindow, err := durationEnv("CHIRP_RESTORE_WINDOW", 72*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	purgeInterval, err := intervalEnv("CHIRP_PURGE_INTERVAL", 10*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	janitorInterval, err := intervalEnv("TOKEN_JANITOR_INTERVAL", time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokenRetention, err := durationEnv("TOKEN_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loginAttempts, err := intEnv("LOGIN_MAX_ATTEMPTS", 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loginLockout, err := durationEnv("LOGIN_LOCKOUT", 15*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// How many open reports hide a chirp until a moderator looks at it;
+	// 0 never hides chirps automatically.
+	reportsToHide, err := intEnv("REPORT_HIDE_THRESHOLD", 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limits, err := loadRateLimits(ratelimit.NewMemoryStore())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := loadMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := loadKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openStore(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if email := os.Getenv("ADMIN_EMAIL"); email != "" {
+		err = bootstrapAdmin(db, email)
+		if err != nil {
+			log.Printf("Couldn't make %s an admin: %v", email, err)
+		}
+	}
+
+	loginAccounts := auth.NewThrottle(auth.ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		LockoutAttempts: loginAttempts,
+		LockoutDuration: loginLockout,
+	})
+	// An IP may be shared by many users, so it gets a larger budget.
+	loginIPs := auth.NewThrottle(auth.ThrottlePolicy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		LockoutAttempts: 5 * loginAttempts,
+		LockoutDuration: loginLockout,
+	})
+
 	apiCfg := apiConfig{
 		fileserverHits: 0,
-		jwt:            os.Getenv("JWT_SECRET"),
+		keys:           keys,
+		baseURL:        strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+		polkaKey:       os.Getenv("POLKA_KEY"),
+		polkaSecret:    os.Getenv("POLKA_WEBHOOK_SECRET"),
+		restoreWindow:  restoreWindow,
+		reportsToHide:  reportsToHide,
+		janitor:        &janitorStats{},
+		loginAccounts:  loginAccounts,
+		loginIPs:       loginIPs,
+		mailer:         mailer,
 		DB:             db,
 	}
 
+	if apiCfg.baseURL == "" {
+		log.Print("PUBLIC_URL is not set; verification emails will contain relative links.")
+	}
+
+	ctx, stopBackground := context.WithCancel(context.Background())
+	go apiCfg.runChirpPurger(ctx, purgeInterval)
+	go apiCfg.runTokenJanitor(ctx, janitorInterval, tokenRetention)
+
 	router := chi.NewRouter()
 	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
 	router.Handle("/app", fsHandler)
 	router.Handle("/app/*", fsHandler)
+	router.Get("/.well-known/jwks.json", apiCfg.handlerJWKS)
+	router.Get("/.well-known/openid-configuration", apiCfg.handlerDiscovery)
 
 	apiRouter := chi.NewRouter()
 	apiRouter.Get("/healthz", handlerReadiness)
-	apiRouter.Get("/chirps", apiCfg.handlerChirpsRetrieve)
-	apiRouter.Get("/chirps/{chirpID}", apiCfg.handlerChirpsGetId)
-	apiRouter.Post("/chirps", apiCfg.handlerChirpsCreate)
-	apiRouter.Post("/users", apiCfg.handlerUsersCreate)
-	apiRouter.Post("/login", apiCfg.handlerUsersLogin)
-	apiRouter.Post("/refresh", apiCfg.handlerTokenRefresh)
-	apiRouter.Put("/users", apiCfg.handlerUsersUpdate)
-	apiRouter.Post("/revoke", apiCfg.handlerRevokeToken)
-	apiRouter.Delete("/chirps/{chirpID}", apiCfg.handlerChirpDelete)
-	apiRouter.Post("/polka/webhooks", apiCfg.handlerPolkaWebooks)
+	apiRouter.Post("/polka/webhooks", apiCfg.handlerPolkaWebhooks)
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.middlewareRateLimit(limits.api))
+		r.Get("/chirps", apiCfg.handlerChirpsRetrieve)
+		r.Get("/chirps/{chirpID}", apiCfg.handlerChirpsGetId)
+		r.Get("/chirps/{chirpID}/revisions", apiCfg.handlerChirpsRevisions)
+		r.With(apiCfg.middlewareRateLimit(limits.signup)).Post("/users", apiCfg.handlerUsersCreate)
+		r.Get("/users/verify", apiCfg.handlerUsersVerify)
+		r.Get("/users/{userID}", apiCfg.handlerUsersGetId)
+		r.With(apiCfg.middlewareRateLimit(limits.signup)).Post("/password/forgot", apiCfg.handlerPasswordForgot)
+		r.Post("/password/reset", apiCfg.handlerPasswordReset)
+		r.Post("/login", apiCfg.handlerUsersLogin)
+		r.Post("/refresh", apiCfg.handlerTokenRefresh)
+		r.Post("/revoke", apiCfg.handlerRevokeToken)
+		r.Group(func(r chi.Router) {
+			r.Use(apiCfg.middlewareAuth)
+			r.Use(apiCfg.middlewareRateLimit(limits.user))
+			chirpLimit := apiCfg.middlewareRateLimit(limits.chirps)
+			r.With(chirpLimit).Post("/chirps", apiCfg.handlerChirpsCreate)
+			r.With(chirpLimit).Put("/chirps/{chirpID}", apiCfg.handlerChirpsUpdate)
+			r.Delete("/chirps/{chirpID}", apiCfg.handlerChirpDelete)
+			r.Post("/chirps/{chirpID}/restore", apiCfg.handlerChirpsRestore)
+			r.Post("/chirps/{chirpID}/reports", apiCfg.handlerChirpsReport)
+			r.Get("/users/me", apiCfg.handlerUsersMe)
+			r.Put("/users", apiCfg.handlerUsersUpdate)
+			r.Patch("/users", apiCfg.handlerUsersUpdate)
+			r.Delete("/users", apiCfg.handlerUsersDelete)
+			r.Get("/users/me/export", apiCfg.handlerUsersExport)
+			r.Post("/users/verify/resend", apiCfg.handlerUsersVerifyResend)
+			r.Get("/sessions", apiCfg.handlerSessionsList)
+			r.Delete("/sessions/{sessionID}", apiCfg.handlerSessionsRevoke)
+			r.Post("/sessions/revoke-all", apiCfg.handlerSessionsRevokeAll)
+		})
+	})
 	router.Mount("/api", apiRouter)
 
 	adminRouter := chi.NewRouter()
-	adminRouter.Get("/metrics", apiCfg.handlerMetrics)
+	adminRouter.Use(apiCfg.middlewareAuth)
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.middlewareRequireRole(database.RoleAdmin))
+		r.Get("/metrics", apiCfg.handlerMetrics)
+		r.Put("/users/{userID}/role", apiCfg.handlerAdminUsersSetRole)
+	})
+	// Moderation is open to moderators as well as admins; admins can do
+	// everything moderators can.
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.middlewareRequireRole(database.RoleModerator))
+		r.Get("/chirps", apiCfg.handlerAdminChirpsList)
+		r.Post("/chirps/{chirpID}/hide", apiCfg.handlerAdminChirpsHide)
+		r.Post("/chirps/{chirpID}/unhide", apiCfg.handlerAdminChirpsUnhide)
+		r.Delete("/chirps/{chirpID}", apiCfg.handlerAdminChirpsDelete)
+		r.Post("/users/{userID}/suspend", apiCfg.handlerAdminUsersSuspend)
+		r.Post("/users/{userID}/unsuspend", apiCfg.handlerAdminUsersUnsuspend)
+		r.Get("/moderation-log", apiCfg.handlerAdminModerationLog)
+		r.Get("/reports", apiCfg.handlerAdminReportsList)
+		r.Post("/chirps/{chirpID}/reports/resolve", apiCfg.handlerAdminReportsResolve)
+	})
 	router.Mount("/admin", adminRouter)
 
 	corsMux := middlewareCors(router)
@@ -63,6 +225,116 @@ func main() {
 		Handler: corsMux,
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Print("Shutting down...")
+	stopBackground()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Server shutdown failed: %v", err)
+	}
+	err = db.Close()
+	if err != nil {
+		log.Fatalf("Failed to flush database: %v", err)
+	}
+}
+
+func runRepair(fix bool) {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "database.json"
+	}
+
+	report, err := database.Repair(path, fix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	if len(report.Problems) == 0 {
+		fmt.Printf("%s: no problems found\n", path)
+	}
+	if report.Fixed {
+		fmt.Printf("%s: repaired\n", path)
+	} else if len(report.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// openStore picks the storage backend. The JSON file store is the default;
+// "sqlite" requires a binary built with the sqlite build tag.
+func openStore(driver, path string) (database.Store, error) {
+	switch driver {
+	case "", "json":
+		if path == "" {
+			path = "database.json"
+		}
+		flushInterval, err := durationEnv("DB_FLUSH_INTERVAL", time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if flushInterval < 0 {
+			return nil, errors.New("invalid DB_FLUSH_INTERVAL: can't be negative")
+		}
+		return database.NewDB(path, database.Options{FlushInterval: flushInterval})
+	case "sqlite":
+		if path == "" {
+			path = "database.sqlite"
+		}
+		return database.NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+}
+
+// durationEnv reads a time.Duration such as "30s" or "72h" from the
+// environment, falling back to def when the variable is unset.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// intervalEnv is durationEnv for how often a background job runs, which
+// must be positive.
+func intervalEnv(name string, def time.Duration) (time.Duration, error) {
+	d, err := durationEnv(name, def)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", name)
+	}
+	return d, nil
+}
+
+func intEnv(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/takacs/go-web/internal/auth"
+	"github.com/takacs/go-web/internal/database"
+	"github.com/takacs/go-web/internal/mail"
+)
+
+func TestMain(m *testing.M) {
+	// Handlers log every call; keep test output readable.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestIntervalEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{env: "", want: time.Minute},
+		{env: "30s", want: 30 * time.Second},
+		{env: "0s", wantErr: true},
+		{env: "-1m", wantErr: true},
+		{env: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_INTERVAL", tt.env)
+		got, err := intervalEnv("TEST_INTERVAL", time.Minute)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("intervalEnv() with %q = %v, %v, want %v, error %v", tt.env, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// newTestConfig returns an apiConfig backed by a fresh database in a
+// temporary directory.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	policy := auth.ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Second, LockoutAttempts: 5, LockoutDuration: time.Minute}
+	return &apiConfig{
+		keys:          newTestKeyring(t, "test-secret"),
+		loginAccounts: auth.NewThrottle(policy),
+		loginIPs:      auth.NewThrottle(policy),
+		mailer:        newTestMailer(),
+		DB:            db,
+	}
+}
+
+// newTestKeyring returns a keyring signing HS256 tokens with secret.
+func newTestKeyring(t *testing.T, secret string) *auth.Keyring {
+	t.Helper()
+	key, err := auth.NewHMACKey("test", []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// testMailer collects sent messages for the test to read back.
+type testMailer struct {
+	sent chan mail.Message
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{sent: make(chan mail.Message, 100)}
+}
+
+func (m *testMailer) Send(msg mail.Message) error {
+	m.sent <- msg
+	return nil
+}
+
+// nextMail returns the next message sent to cfg's mailer, waiting for
+// mail sent in the background.
+func nextMail(t *testing.T, cfg *apiConfig) mail.Message {
+	t.Helper()
+	select {
+	case msg := <-cfg.mailer.(*testMailer).sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail was sent")
+		return mail.Message{}
+	}
+}
+
+// mailToken returns the token query parameter of the link in msg.
+func mailToken(t *testing.T, msg mail.Message) string {
+	t.Helper()
+	_, rest, found := strings.Cut(msg.Body, "token=")
+	if !found {
+		t.Fatalf("no token link in mail %q", msg.Body)
+	}
+	token, _, _ := strings.Cut(rest, "\n")
+	token, err := url.QueryUnescape(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve sends a request with the given body and headers through h and
+// returns the recorded response.
+func serve(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// accessToken returns a valid access token for userID, claiming the role
+// user.
+func accessToken(t *testing.T, cfg *apiConfig, userID int) string {
+	t.Helper()
+	return mustCreateJwt(t, cfg, database.User{ID: userID, Role: database.RoleUser})
+}
+
+// mustCreateJwt starts a session for user and returns an access token for
+// it claiming the role of user.
+func mustCreateJwt(t *testing.T, cfg *apiConfig, user database.User) string {
+	t.Helper()
+	sessionID, err := auth.RandomString(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stored, err := newRefreshToken("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	err = cfg.DB.CreateSession(database.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  stored.ExpiresAt,
+	}, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := cfg.createJwt(user, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// sessionOf returns the session an access token belongs to.
+func sessionOf(t *testing.T, cfg *apiConfig, token string) string {
+	t.Helper()
+	caller, err := cfg.parseToken(token, Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller.SessionID
+}
+
+// bearer returns the Authorization header for an access token.
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// login logs in through handlerUsersLogin and returns the response.
+func login(t *testing.T, cfg *apiConfig, email, password string) loginResponse {
+	t.Helper()
+	body := fmt.Sprintf(`{"email":%q,"password":%q}`, email, password)
+	w := serve(http.HandlerFunc(cfg.handlerUsersLogin), "POST", "/api/login", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status = %d: %s", w.Code, w.Body)
+	}
+	resp := loginResponse{}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
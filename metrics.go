@@ -2,10 +2,22 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"net/http"
+	"time"
 )
 
 func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	runs, lastRun, lastErr, removed := cfg.janitor.snapshot()
+	lastRunText := "never"
+	if !lastRun.IsZero() {
+		lastRunText = lastRun.UTC().Format(time.RFC3339)
+	}
+	lastErrText := "none"
+	if lastErr != nil {
+		lastErrText = lastErr.Error()
+	}
+
 	w.Header().Add("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`
@@ -14,10 +26,14 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
 <body>
 	<h1>Welcome, Chirpy Admin</h1>
 	<p>Chirpy has been visited %dtimes!</p>
+	<h2>Token janitor</h2>
+	<p>Runs: %d, last run: %s, last error: %s</p>
+	<p>Removed %d refresh tokens, %d sessions, %d denied tokens and %d password resets.</p>
 </body>
 
 </html>
-	`, cfg.fileserverHits)))
+	`, cfg.fileserverHits, runs, lastRunText, html.EscapeString(lastErrText),
+		removed.RefreshTokens, removed.Sessions, removed.DeniedTokens, removed.PasswordResets)))
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/database"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	UserID int
+	// SessionID is the login the access token belongs to.
+	SessionID string
+	// TokenID and ExpiresAt identify the access token, for revoking it.
+	TokenID   string
+	ExpiresAt time.Time
+	// Role is the user's stored role. The token's role claim may be out
+	// of date, so it isn't trusted.
+	Role database.Role
+}
+
+type principalKey struct{}
+
+// middlewareAuth rejects requests without a valid access token, or whose
+// user has since deleted their account or been suspended, and stores the
+// caller in the request context for principalFromContext.
+func (cfg *apiConfig) middlewareAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, err := bearerToken(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		caller, err := cfg.parseToken(tokenString, Access)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		user, err := cfg.DB.GetUser(caller.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "User not found.")
+			return
+		}
+		if user.IsSuspended() {
+			respondWithError(w, http.StatusForbidden, errAccountSuspended.Error())
+			return
+		}
+		caller.Role = user.Role
+
+		ctx := context.WithValue(r.Context(), principalKey{}, caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// middlewareRequireRole only lets through callers with at least the given
+// role. It must run after middlewareAuth, which loads the stored role, so
+// promotions and demotions take effect on the next request.
+func (cfg *apiConfig) middlewareRequireRole(min database.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller, ok := principalFromContext(r.Context())
+			if !ok {
+				respondWithError(w, http.StatusUnauthorized, "Not authenticated.")
+				return
+			}
+			if !caller.Role.AtLeast(min) {
+				respondWithError(w, http.StatusForbidden, "Forbidden.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// principalFromContext returns the caller stored by middlewareAuth.
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("No auth header")
+	}
+	tokenString, found := strings.CutPrefix(authHeader, "Bearer ")
+	if !found || tokenString == "" {
+		return "", errors.New("malformed authorization header")
+	}
+	return tokenString, nil
+}
+
+// parseToken validates a token issued by createJwt for the given issuer,
+// checks that neither it nor its session has been revoked and returns the
+// caller it identifies. Checking the session means signing out a session,
+// or every other session after a credential change, cuts off its access
+// tokens at once instead of when they expire.
+func (cfg *apiConfig) parseToken(tokenString, issuer string) (principal, error) {
+	claimsStruct := accessClaims{}
+	_, err := cfg.keys.Parse(tokenString, &claimsStruct, jwt.WithIssuer(issuer))
+	if err != nil {
+		return principal{}, err
+	}
+
+	userID, err := strconv.Atoi(claimsStruct.Subject)
+	if err != nil {
+		return principal{}, errors.New("Invalid subject.")
+	}
+	caller := principal{
+		UserID:    userID,
+		SessionID: claimsStruct.SessionID,
+		TokenID:   claimsStruct.ID,
+	}
+	if claimsStruct.ExpiresAt != nil {
+		caller.ExpiresAt = claimsStruct.ExpiresAt.Time
+	}
+
+	// Tokens issued before jti was added can't be revoked; they expire
+	// within the hour anyway.
+	if caller.TokenID != "" {
+		denied, err := cfg.DB.IsTokenDenied(caller.TokenID)
+		if err != nil {
+			return principal{}, err
+		}
+		if denied {
+			return principal{}, errors.New("Token has been revoked.")
+		}
+	}
+
+	if caller.SessionID == "" {
+		return principal{}, errors.New("Token has no session; log in again.")
+	}
+	session, err := cfg.DB.GetSession(caller.UserID, caller.SessionID)
+	if errors.Is(err, database.ErrSessionNotFound) || (err == nil && !session.IsActive(time.Now())) {
+		return principal{}, errors.New("Session has been revoked or has expired.")
+	}
+	if err != nil {
+		return principal{}, err
+	}
+	return caller, nil
+}
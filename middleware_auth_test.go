@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/takacs/go-web/internal/auth"
+)
+
+func TestMiddlewareAuth(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := cfg.middlewareAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := principalFromContext(r.Context())
+		if !ok {
+			t.Error("no principal in the request context")
+		}
+		w.Write([]byte(strconv.Itoa(caller.UserID)))
+	}))
+	sign := func(keys *auth.Keyring, claims jwt.RegisteredClaims) string {
+		token, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expired := sign(cfg.keys, jwt.RegisteredClaims{
+		Issuer:    Access,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	})
+	otherIssuer := sign(cfg.keys, jwt.RegisteredClaims{
+		Issuer:    "chirpy-refresh",
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	forged := sign(newTestKeyring(t, "other-secret"), jwt.RegisteredClaims{
+		Issuer:    Access,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	noSession := sign(cfg.keys, jwt.RegisteredClaims{
+		Issuer:    Access,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	revoked := accessToken(t, cfg, user.ID)
+	_, err = cfg.DB.RevokeAllSessions(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+	}{
+		{"access token", bearer(accessToken(t, cfg, user.ID)), http.StatusOK},
+		{"no header", nil, http.StatusUnauthorized},
+		{"wrong scheme", http.Header{"Authorization": {"Basic " + accessToken(t, cfg, user.ID)}}, http.StatusUnauthorized},
+		{"empty token", bearer(""), http.StatusUnauthorized},
+		{"other issuer", bearer(otherIssuer), http.StatusUnauthorized},
+		{"expired", bearer(expired), http.StatusUnauthorized},
+		{"other secret", bearer(forged), http.StatusUnauthorized},
+		{"no session", bearer(noSession), http.StatusUnauthorized},
+		{"revoked session", bearer(revoked), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(handler, "GET", "/api/users", "", tt.header)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && w.Body.String() != "1" {
+				t.Errorf("principal user ID = %s, want 1", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/takacs/go-web/internal/ratelimit"
+)
+
+// middlewareRateLimit rejects requests over the limiter's budget with 429.
+// Budgets are per user behind middlewareAuth and per client IP elsewhere.
+func (cfg *apiConfig) middlewareRateLimit(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "ip:" + clientIP(r)
+			if caller, ok := principalFromContext(r.Context()); ok {
+				key = "user:" + strconv.Itoa(caller.UserID)
+			}
+
+			result, err := limiter.Allow(key)
+			if err != nil {
+				// Fail open: an unavailable limit store shouldn't take the API down.
+				log.Printf("Rate limiter error: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			ratelimit.SetHeaders(w.Header(), result)
+			if !result.Allowed {
+				respondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded. Try again later.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitEnv reads a rate limit such as "30/1m" from the environment.
+func limitEnv(name string, def ratelimit.Limit) (ratelimit.Limit, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	limit, err := ratelimit.ParseLimit(value)
+	if err != nil {
+		return ratelimit.Limit{}, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return limit, nil
+}
+
+// rateLimits are the limiters applied to the API route groups.
+type rateLimits struct {
+	// api limits every API request per client IP.
+	api *ratelimit.Limiter
+	// user limits authenticated requests per user.
+	user *ratelimit.Limiter
+	// chirps limits creating and editing chirps per user.
+	chirps *ratelimit.Limiter
+	// signup limits account creation and password reset emails per client
+	// IP.
+	signup *ratelimit.Limiter
+}
+
+// loadRateLimits builds the limiters from RATE_LIMIT_* variables, keeping
+// their buckets in store.
+func loadRateLimits(store ratelimit.Store) (rateLimits, error) {
+	limits := rateLimits{}
+	var err error
+	limits.api, err = newLimiter(store, "api", ratelimit.Limit{Requests: 300, Per: time.Minute})
+	if err != nil {
+		return rateLimits{}, err
+	}
+	limits.user, err = newLimiter(store, "user", ratelimit.Limit{Requests: 120, Per: time.Minute})
+	if err != nil {
+		return rateLimits{}, err
+	}
+	limits.chirps, err = newLimiter(store, "chirps", ratelimit.Limit{Requests: 30, Per: time.Minute})
+	if err != nil {
+		return rateLimits{}, err
+	}
+	limits.signup, err = newLimiter(store, "signup", ratelimit.Limit{Requests: 10, Per: time.Hour})
+	if err != nil {
+		return rateLimits{}, err
+	}
+	return limits, nil
+}
+
+// newLimiter returns the limiter for a route group, with its limit read from
+// RATE_LIMIT_<NAME> if set.
+func newLimiter(store ratelimit.Store, name string, def ratelimit.Limit) (*ratelimit.Limiter, error) {
+	limit, err := limitEnv("RATE_LIMIT_"+strings.ToUpper(name), def)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.New(name, limit, store), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/takacs/go-web/internal/ratelimit"
+)
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	limiter := ratelimit.New("test", ratelimit.Limit{Requests: 2, Per: time.Hour}, ratelimit.NewMemoryStore())
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	public := cfg.middlewareRateLimit(limiter)(ok)
+	private := cfg.middlewareAuth(cfg.middlewareRateLimit(limiter)(ok))
+
+	for i := 0; i < 2; i++ {
+		w := serve(public, "GET", "/api/chirps", "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+		if w.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("RateLimit-Limit = %q, want 2", w.Header().Get("RateLimit-Limit"))
+		}
+	}
+	w := serve(public, "GET", "/api/chirps", "", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: status = %d, Retry-After %q; want %d with Retry-After",
+			w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	// Authenticated callers have their own budget, apart from their IP's.
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		_, err := cfg.DB.CreateUser(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := accessToken(t, cfg, 1)
+	for i := 0; i < 2; i++ {
+		if code := serve(private, "GET", "/api/sessions", "", bearer(token)).Code; code != http.StatusOK {
+			t.Fatalf("user request %d: status = %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+	if code := serve(private, "GET", "/api/sessions", "", bearer(token)).Code; code != http.StatusTooManyRequests {
+		t.Errorf("user over the limit: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := serve(private, "GET", "/api/sessions", "", bearer(accessToken(t, cfg, 2))).Code; code != http.StatusOK {
+		t.Errorf("another user: status = %d, want %d", code, http.StatusOK)
+	}
+}
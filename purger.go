@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runChirpPurger hard-deletes chirps whose restore window has passed. It
+// checks every interval until ctx is cancelled.
+func (cfg *apiConfig) runChirpPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			purged, err := cfg.DB.PurgeChirps(time.Now().Add(-cfg.restoreWindow))
+			if err != nil {
+				log.Printf("Failed to purge deleted chirps: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted chirps.", purged)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
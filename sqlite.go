@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// Registers the pure-Go SQLite driver used by database.NewSQLiteDB.
+import _ "modernc.org/sqlite"